@@ -6,7 +6,21 @@ import (
 	"time"
 	"unicode/utf8"
 
+	"github.com/google/uuid"
 	"github.com/pkg/errors"
+
+	"github.com/charlesbases/library"
+	"github.com/charlesbases/library/codec"
+	"github.com/charlesbases/library/codec/json"
+	"github.com/charlesbases/library/content"
+
+	// 注册内置的 codec.Marshaler, 订阅方按 HeaderContentType 解码
+	_ "github.com/charlesbases/library/codec/cbor"
+	_ "github.com/charlesbases/library/codec/msgpack"
+	_ "github.com/charlesbases/library/codec/protojson"
+
+	// 注册压缩编码, 订阅方按 HeaderContentEncoding 解压
+	_ "github.com/charlesbases/library/codec/compress"
 )
 
 var (
@@ -16,11 +30,44 @@ var (
 	defaultCallerSkip = 1
 	// defaultReconnectWait 重连等待时间
 	defaultReconnectWait = time.Second * 3
+	// defaultMaxReconnectWait 最大重连等待时间
+	defaultMaxReconnectWait = time.Minute
+	// defaultMaxAttempts handler 默认执行次数
+	defaultMaxAttempts = 1
+	// defaultConcurrency 订阅默认的最大并发数
+	defaultConcurrency = 16
 
 	// ErrNotReady .
 	ErrNotReady = errors.New("connection not ready")
 	// ErrInvalidAddrs .
 	ErrInvalidAddrs = errors.New("invalid addrs")
+	// ErrInvalidCertificate .
+	ErrInvalidCertificate = errors.New("invalid certificate")
+	// ErrNotRequest 消息不是请求, 无法应答
+	ErrNotRequest = errors.New("event is not a request")
+	// ErrRequestTimeout 请求超时
+	ErrRequestTimeout = errors.New("request timeout")
+	// ErrPublishTimeout 同步发布等待确认超时
+	ErrPublishTimeout = errors.New("publish timeout")
+	// ErrDelayNotSupported 延迟发布需要通过 broker/scheduler
+	ErrDelayNotSupported = errors.New("delayed publishing is not supported, use broker/scheduler")
+	// ErrStartNotSupported 不支持的订阅起始位置
+	ErrStartNotSupported = errors.New("start position is not supported")
+	// ErrRedeliver handler 返回该错误时, 消息重试后不进入死信, 而是重新投递
+	ErrRedeliver = errors.New("message should be redelivered")
+)
+
+const (
+	// HeaderReplyTo 请求的应答地址
+	HeaderReplyTo = "Reply-To"
+	// HeaderKey 消息 key, 见 PublishOptions.Key
+	HeaderKey = "Message-Key"
+	// HeaderCorrelationID 请求唯一标识, 用于匹配请求与应答
+	HeaderCorrelationID = "Correlation-ID"
+	// HeaderContentType 消息格式, 见 PublishOptions.Codec。订阅方按此选择已注册的 codec.Marshaler
+	HeaderContentType = "Content-Type"
+	// HeaderContentEncoding 消息编码(如压缩、加密), 见 codec.ContentEncoding。订阅方按此包装 codec.Marshaler 后解码
+	HeaderContentEncoding = "Content-Encoding"
 )
 
 // Client .
@@ -29,14 +76,58 @@ type Client interface {
 	// 若发布消息格式为 json, 则参数 'v' 为 JsonMessage.Data
 	// 若发布消息格式为 proto, 则参数 'v' 为发布的完整消息体, 方法内不做额外的封装
 	Publish(topic string, v interface{}, opts ...func(o *PublishOptions)) error
+	// PublishSync 同步发布消息, 在 PublishOptions.Timeout 内等待 broker 确认消息已持久化
+	PublishSync(topic string, v interface{}, opts ...func(o *PublishOptions)) (*Receipt, error)
+	// PublishBatch 批量发布消息, 在 PublishOptions.Timeout 内等待全部消息确认。
+	// 返回的结果与 vs 一一对应; error 不为空时整批消息均未发布, 如 topic 不合法
+	PublishBatch(topic string, vs []interface{}, opts ...func(o *PublishOptions)) ([]Result, error)
 	// Subscribe 消息订阅
-	Subscribe(topic string, handler Handler, opts ...func(o *SubscribeOptions)) error
+	Subscribe(topic string, handler Handler, opts ...func(o *SubscribeOptions)) (Subscription, error)
+	// Request 发送请求, 并在 'timeout' 内等待应答。订阅者通过 Event.Respond 应答请求
+	Request(topic string, v interface{}, timeout time.Duration, opts ...func(o *PublishOptions)) (Event, error)
+	// Healthy 连接是否可用
+	Healthy() bool
 	// Close .
 	Close()
 }
 
+// Receipt 消息发布回执
+type Receipt struct {
+	// Topic .
+	Topic string
+	// Stream nats stream 或 redis stream
+	Stream string
+	// ID redis stream entry id
+	ID string
+	// Sequence nats stream sequence
+	Sequence uint64
+	// Partition kafka partition
+	Partition int32
+	// Offset kafka offset
+	Offset int64
+}
+
+// Result 批量发布中单条消息的结果
+type Result struct {
+	// Receipt 发布成功时的回执
+	Receipt *Receipt
+	// Err 发布失败的原因
+	Err error
+}
+
+// Subscription 消息订阅
+type Subscription interface {
+	// Topic .
+	Topic() string
+	// Unsubscribe 取消订阅。不再接收新消息, 正在处理的消息的 ctx 将被取消
+	Unsubscribe() error
+	// Drain 取消订阅, 并等待已接收的消息处理完成
+	Drain() error
+}
+
 // Handler with Subscribe
-type Handler func(event Event) error
+// ctx 为 Event.Context(), 包含发布方写入消息头的 metadata.Metadata 和 trace id
+type Handler func(ctx context.Context, event Event) error
 
 // JsonMessage .
 type JsonMessage struct {
@@ -50,13 +141,72 @@ type JsonMessage struct {
 	Data interface{} `json:"data"`
 }
 
-// CheckSubject .
+// Raw 已编码的消息。发布时不再编码, 格式需与 PublishOptions.Codec 一致
+type Raw []byte
+
+// Marshal 消息编码
+// 若 codec 只能编码特定类型(如 proto), 则直接编码 'v', 见 codec.Enveloper; 否则将 'v' 封装为 JsonMessage 后编码; 若 'v' 为 Raw, 则原样返回
+func Marshal(producer string, v interface{}, c codec.Marshaler) ([]byte, error) {
+	if raw, ok := v.(Raw); ok {
+		return raw, nil
+	}
+
+	if !codec.Envelope(c) {
+		return c.Marshal(v)
+	}
+
+	return c.Marshal(
+		&JsonMessage{
+			ID:        uuid.NewString(),
+			Producer:  producer,
+			CreatedAt: library.NowString(),
+			Data:      v,
+		},
+	)
+}
+
+// LookupCodec content-type 对应的 codec.Marshaler。未注册时返回 json.Marshaler
+func LookupCodec(contentType string) codec.Marshaler {
+	if m, found := codec.Lookup(content.Convert(contentType)); found {
+		return m
+	}
+	return json.Marshaler
+}
+
+// lookupCodec 按消息头中的 HeaderContentType 与 HeaderContentEncoding 选择解码使用的 codec.Marshaler。
+// 与 'm' 一致, 或编码未注册(如未调用 encrypt.Register)且格式一致时使用 'm'
+func lookupCodec(header Header, m codec.Marshaler) codec.Marshaler {
+	var contentType = header.Get(HeaderContentType)
+	if len(contentType) == 0 {
+		return m
+	}
+
+	var contentEncoding = header.Get(HeaderContentEncoding)
+	if contentType == m.ContentType().String() && contentEncoding == codec.ContentEncoding(m) {
+		return m
+	}
+
+	if wrapped, found := codec.LookupEncoding(LookupCodec(contentType), contentEncoding); found {
+		return wrapped
+	}
+	if contentType == m.ContentType().String() {
+		return m
+	}
+	return LookupCodec(contentType)
+}
+
+// CheckSubject 检查 topic。topic 可以使用 '.' 分层, 如 "orders.created"
 func CheckSubject(t string) error {
 	if len(strings.TrimSpace(t)) == 0 {
 		return errors.New("topic cannot be empty")
 	}
-	if strings.Contains(t, ".") {
-		return errors.New("topic cannot contain '.'")
+	if strings.ContainsAny(t, "*> \t\r\n") {
+		return errors.New("topic cannot contain wildcards or whitespace")
+	}
+	for _, token := range strings.Split(t, ".") {
+		if len(token) == 0 {
+			return errors.New("topic cannot contain empty tokens")
+		}
 	}
 	if !utf8.ValidString(t) {
 		return errors.New("topic with non UTF-8 strings are not supported")
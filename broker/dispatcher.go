@@ -0,0 +1,56 @@
+package broker
+
+import (
+	"context"
+	"sync"
+)
+
+// Dispatcher 调度消息处理。
+// 同时处理的消息数不超过 SubscribeOptions.Concurrency, 达到上限时 Dispatch 阻塞, 从而暂停消费;
+// 顺序消费时, 相同 key 的消息依次处理
+type Dispatcher struct {
+	ctx    context.Context
+	tokens chan struct{}
+	seq    *sequencer
+
+	inflight sync.WaitGroup
+}
+
+// NewDispatcher .
+func NewDispatcher(o *SubscribeOptions) *Dispatcher {
+	var d = &Dispatcher{ctx: o.Context, tokens: make(chan struct{}, o.Concurrency)}
+	if o.Ordered {
+		d.seq = newSequencer()
+	}
+	return d
+}
+
+// Dispatch 异步执行 fn。达到并发上限时阻塞, 直到有消息处理完成; SubscribeOptions.Context 结束时返回 false, fn 不会执行
+func (d *Dispatcher) Dispatch(key string, fn func()) bool {
+	select {
+	case d.tokens <- struct{}{}:
+	case <-d.ctx.Done():
+		return false
+	}
+
+	d.inflight.Add(1)
+	var task = func() {
+		defer func() {
+			<-d.tokens
+			d.inflight.Done()
+		}()
+		fn()
+	}
+
+	if d.seq != nil {
+		d.seq.Go(key, task)
+	} else {
+		go task()
+	}
+	return true
+}
+
+// Wait 等待已调度的消息处理完成
+func (d *Dispatcher) Wait() {
+	d.inflight.Wait()
+}
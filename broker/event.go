@@ -1,23 +1,35 @@
 package broker
 
 import (
-	"github.com/pkg/errors"
+	"context"
+	"reflect"
 
 	"github.com/charlesbases/library/codec"
-	"github.com/charlesbases/library/content"
 )
 
 // Event .
 type Event interface {
+	// ID 消息唯一标识, 即 JsonMessage.ID。消息没有封装(如 proto)时, 返回空
+	ID() string
 	// Topic .
 	Topic() string
-	// Reply .
+	// Key 消息 key, 见 PublishOptions.Key
+	Key() string
+	// Reply 请求的应答地址。若消息不是请求, 则为空
 	Reply() string
+	// Header 消息头
+	Header() Header
+	// Context 消息上下文, 包含发布方写入消息头的 metadata.Metadata 和 trace id
+	Context() context.Context
 	// Body return bytes of message
 	Body() []byte
+	// Codec 消息的编码方式, 见 HeaderContentType
+	Codec() codec.Marshaler
 	// Unmarshal unmarshal message
-	// 若消息格式为 json, 则反序列化 message.data; 若消息格式为 proto, 则反序列化 message
+	// 若消息使用 JsonMessage 封装, 则反序列化 JsonMessage.Data; 否则(如 proto)反序列化 message
 	Unmarshal(v interface{}) error
+	// Respond 应答请求
+	Respond(v interface{}, opts ...func(o *PublishOptions)) error
 }
 
 // event .
@@ -26,6 +38,25 @@ type event struct {
 	reply string
 	body  []byte
 	codec codec.Marshaler
+
+	ctx       context.Context
+	header    Header
+	responder Responder
+}
+
+// ID .
+func (e *event) ID() string {
+	if !codec.Envelope(e.codec) {
+		return ""
+	}
+
+	var m = new(struct {
+		ID string `json:"id"`
+	})
+	if err := e.codec.Unmarshal(e.body, m); err != nil {
+		return ""
+	}
+	return m.ID
 }
 
 // Topic .
@@ -33,29 +64,76 @@ func (e *event) Topic() string {
 	return e.topic
 }
 
+// Key .
+func (e *event) Key() string {
+	return e.header.Get(HeaderKey)
+}
+
 // Reply .
 func (e *event) Reply() string {
 	return e.reply
 }
 
+// Header .
+func (e *event) Header() Header {
+	return e.header
+}
+
+// Context .
+func (e *event) Context() context.Context {
+	return e.ctx
+}
+
 // Body .
 func (e *event) Body() []byte {
 	return e.body
 }
 
+// Codec .
+func (e *event) Codec() codec.Marshaler {
+	return e.codec
+}
+
 // Unmarshal .
 func (e *event) Unmarshal(v interface{}) error {
-	switch e.codec.ContentType() {
-	case content.Json:
-		return e.codec.Unmarshal(e.body, &JsonMessage{Data: v})
-	case content.Proto:
+	if !codec.Envelope(e.codec) {
 		return e.codec.Unmarshal(e.body, v)
-	default:
-		return errors.Errorf("unsupported of %s", e.codec.ContentType().String())
 	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return e.codec.Unmarshal(e.body, &JsonMessage{Data: v})
+	}
+
+	// Data 字段使用 'v' 的类型。部分 codec(如 cbor)解码时会替换 interface{} 字段中已有的值
+	data := reflect.New(reflect.StructOf([]reflect.StructField{{Name: "Data", Type: rv.Type(), Tag: `json:"data"`}}))
+	data.Elem().Field(0).Set(rv)
+	return e.codec.Unmarshal(e.body, data.Interface())
+}
+
+// Respond .
+func (e *event) Respond(v interface{}, opts ...func(o *PublishOptions)) error {
+	if len(e.reply) == 0 || e.responder == nil {
+		return ErrNotRequest
+	}
+	return e.responder(v, opts...)
 }
 
-// NewEvent .
-func NewEvent(topic string, reply string, body []byte, codec codec.Marshaler) Event {
-	return &event{topic: topic, reply: reply, body: body, codec: codec}
+// NewEvent 消息头中的 HeaderContentType 或 HeaderContentEncoding 与 'codec' 不一致时, 使用已注册的 codec.Marshaler 解码,
+// 压缩、加密的消息按 HeaderContentEncoding 包装后解码。一致时使用 'codec
+func NewEvent(topic string, reply string, body []byte, codec codec.Marshaler, opts ...func(o *EventOptions)) Event {
+	var o = ParseEventOptions(opts...)
+	if o.Header == nil {
+		o.Header = make(Header)
+	}
+
+	return &event{
+		topic:     topic,
+		reply:     reply,
+		body:      body,
+		codec:     lookupCodec(o.Header, codec),
+		ctx:       Extract(o.Context, o.Header),
+		header:    o.Header,
+		responder: o.Responder,
+	}
 }
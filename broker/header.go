@@ -0,0 +1,87 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/charlesbases/library"
+	"github.com/charlesbases/library/metadata"
+)
+
+// reserved 内部使用的 header, 不会写入 metadata
+var reserved = map[string]bool{
+	HeaderReplyTo:         true,
+	HeaderCorrelationID:   true,
+	HeaderKey:             true,
+	HeaderContentType:     true,
+	HeaderContentEncoding: true,
+	library.HeaderTraceID: true,
+}
+
+// Header 消息头
+type Header map[string]string
+
+// Get .
+func (h Header) Get(key string) string {
+	return h[key]
+}
+
+// Set .
+func (h Header) Set(key string, val string) {
+	h[key] = val
+}
+
+// Clone .
+func (h Header) Clone() Header {
+	var out = make(Header, len(h))
+	for key, val := range h {
+		out[key] = val
+	}
+	return out
+}
+
+// Inject 将 ctx 中的 metadata.Metadata 和 trace id 写入 header。h 中已存在的 key 优先
+func Inject(ctx context.Context, h Header) Header {
+	var out = make(Header, len(h))
+
+	if ctx != nil {
+		if md, ok := metadata.FromContext(ctx); ok {
+			for key, val := range md {
+				out[key] = fmt.Sprint(val)
+			}
+		}
+
+		switch id := ctx.Value(library.HeaderTraceID).(type) {
+		case string:
+			out[library.HeaderTraceID] = id
+		case fmt.Stringer:
+			out[library.HeaderTraceID] = id.String()
+		}
+	}
+
+	for key, val := range h {
+		out[key] = val
+	}
+	return out
+}
+
+// Extract 将 header 中的 trace id 和 metadata 写入 ctx
+func Extract(ctx context.Context, h Header) context.Context {
+	if id := h.Get(library.HeaderTraceID); len(id) != 0 {
+		ctx = context.WithValue(ctx, library.HeaderTraceID, id)
+	}
+
+	var md = make(metadata.Metadata, len(h))
+	for key, val := range h {
+		if !reserved[key] {
+			md[key] = val
+		}
+	}
+	if md.Len() != 0 {
+		if parent, ok := metadata.FromContext(ctx); ok {
+			md = metadata.Join(parent, md)
+		}
+		ctx = md.WithContext(ctx)
+	}
+	return ctx
+}
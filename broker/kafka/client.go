@@ -1,23 +1,85 @@
 package kafka
 
 import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
 
 	"github.com/IBM/sarama"
-	"github.com/google/uuid"
 
 	"github.com/charlesbases/logger"
 
-	"github.com/charlesbases/library"
 	"github.com/charlesbases/library/broker"
-	"github.com/charlesbases/library/content"
 )
 
+// watermark 分区的 offset 提交水位。
+// 消息并发处理时完成顺序与 offset 顺序不一致, 仅当更小的 offset 全部处理完成后才提交;
+// 消息 nack 后不再提交, 由 consumer group 重新加入后从已提交的 offset 重新投递
+type watermark struct {
+	lock sync.Mutex
+	// pending 已分发未提交的 offset, 升序
+	pending []int64
+	// done 已处理完成, 等待更小的 offset 完成后提交
+	done map[int64]struct{}
+
+	nacked chan struct{}
+	once   sync.Once
+}
+
+// newWatermark .
+func newWatermark() *watermark {
+	return &watermark{done: make(map[int64]struct{}), nacked: make(chan struct{})}
+}
+
+// add 记录已分发的 offset
+func (w *watermark) add(offset int64) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.pending = append(w.pending, offset)
+}
+
+// ack 消息处理完成。返回可提交的 offset, 即下一条待消费消息的 offset
+func (w *watermark) ack(offset int64) (next int64, ok bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	select {
+	case <-w.nacked:
+		return 0, false
+	default:
+	}
+
+	w.done[offset] = struct{}{}
+	for len(w.pending) != 0 {
+		var head = w.pending[0]
+		if _, found := w.done[head]; !found {
+			break
+		}
+
+		delete(w.done, head)
+		w.pending = w.pending[1:]
+		next, ok = head+1, true
+	}
+	return next, ok
+}
+
+// nack 消息处理失败。此后不再提交 offset
+func (w *watermark) nack() {
+	w.once.Do(func() {
+		close(w.nacked)
+	})
+}
+
 // consumerGroup .
 type consumerGroup struct {
 	client *client
+	sub    *subscription
+	group  string
 	opts   *broker.SubscribeOptions
 
 	h broker.Handler
@@ -35,24 +97,64 @@ func (c *consumerGroup) Cleanup(session sarama.ConsumerGroupSession) error {
 
 // ConsumeClaim .
 func (c *consumerGroup) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	var w = newWatermark()
+
 	for {
 		select {
 		case <-c.client.closing:
 			return nil
+		case <-c.sub.closing:
+			// Drain 时等待已接收的消息处理完成, 以便在 session 结束前提交 offset
+			if c.sub.draining {
+				c.sub.dispatcher.Wait()
+			}
+			return nil
+		case <-w.nacked:
+			// 停止消费该分区, sarama 随之结束本次 session, 重新加入后从未确认的消息开始重新投递
+			logger.Debugf(`[kafka]: consume["%s"]: partition: %d: redeliver`, claim.Topic(), claim.Partition())
+			return nil
 		case message, ok := <-claim.Messages():
 			if !ok {
 				return nil
 			}
 
-			session.MarkMessage(message, "")
+			broker.ObserveLag(message.Topic, c.group, message.Partition, claim.HighWaterMarkOffset()-message.Offset-1)
+
+			var header = brokerHeader(message.Headers)
+			if len(message.Key) != 0 {
+				header.Set(broker.HeaderKey, string(message.Key))
+			}
+			var reply = header.Get(broker.HeaderReplyTo)
+
+			var event = broker.NewEvent(
+				message.Topic, reply, message.Value, c.opts.Codec, func(eo *broker.EventOptions) {
+					eo.Context = c.opts.Context
+					eo.Header = header
+				}, c.client.responder(reply, header.Get(broker.HeaderCorrelationID)),
+			)
+
+			logger.Context(event.Context()).Debugf(`[kafka]: consume["%s"]: %s`, message.Topic, event.Codec().RawMessage(message.Value))
 
-			logger.Debugf(`[kafka]: consume["%s"]: %s`, message.Topic, c.opts.Codec.RawMessage(message.Value))
+			w.add(message.Offset)
+
+			// 达到并发上限时阻塞, 暂停拉取消息
+			if !c.sub.dispatcher.Dispatch(event.Key(), func() {
+				ack, err := broker.Retry(c.client, event, c.h, c.opts)
+				if err != nil {
+					logger.Context(event.Context()).Errorf(`[kafka]: consume["%s"]: %v`, message.Topic, err)
+				}
 
-			go func() {
-				if err := c.h(broker.NewEvent(message.Topic, message.Topic, message.Value, c.opts.Codec)); err != nil {
-					logger.Errorf(`[kafka]: consume["%s"]: %v`, message.Topic, err)
+				// handler 执行成功或进入死信后提交 offset; 否则停止提交, 等待重新投递
+				if !ack {
+					w.nack()
+					return
+				}
+				if next, ok := w.ack(message.Offset); ok {
+					session.MarkOffset(message.Topic, message.Partition, next, "")
 				}
-			}()
+			}) {
+				return nil
+			}
 		}
 	}
 }
@@ -63,11 +165,70 @@ type client struct {
 	opts *broker.Options
 	conf *sarama.Config
 
+	// sess 当前连接, 重连时替换
+	sess *session
+	lock sync.RWMutex
+
+	replies *replies
+
+	actived atomic.Bool
+	healthy atomic.Bool
+	closing chan struct{}
+}
+
+// session 一次 kafka 连接。重连时创建新的 session, 并关闭旧的 session
+type session struct {
 	client   sarama.Client
 	producer sarama.AsyncProducer
 
-	actived bool
+	// closing session 关闭, 订阅需在新的 session 上恢复
 	closing chan struct{}
+	// drained producer 的发送结果已全部处理
+	drained chan struct{}
+}
+
+// daemon 处理发送结果, producer 关闭后退出
+func (s *session) daemon() {
+	defer close(s.drained)
+
+	successes, errs := s.producer.Successes(), s.producer.Errors()
+	for successes != nil || errs != nil {
+		select {
+		case msg, ok := <-successes:
+			if !ok {
+				successes = nil
+				continue
+			}
+			acked(msg, nil)
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			logger.Errorf(`[kafka]: produce["%s"]: %v`, err.Msg.Topic, err.Err)
+			acked(err.Msg, err.Err)
+		}
+	}
+}
+
+// closed .
+func (s *session) closed() bool {
+	select {
+	case <-s.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// close 等待已发送消息的结果后关闭 client
+func (s *session) close() {
+	close(s.closing)
+
+	s.producer.AsyncClose()
+	<-s.drained
+
+	s.client.Close()
 }
 
 // version .
@@ -76,78 +237,198 @@ func (c *client) version(ver *sarama.KafkaVersion) (err error) {
 	return err
 }
 
-func (c *client) connect() (err error) {
+// dial 创建 session
+func (c *client) dial() (*session, error) {
 	// client
-	c.client, err = sarama.NewClient([]string{c.opts.Address}, c.conf)
+	cli, err := sarama.NewClient(c.opts.Addresses(), c.conf)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// producer
-	c.producer, err = sarama.NewAsyncProducerFromClient(c.client)
+	producer, err := sarama.NewAsyncProducerFromClient(cli)
+	if err != nil {
+		cli.Close()
+		return nil, err
+	}
+
+	sess := &session{client: cli, producer: producer, closing: make(chan struct{}), drained: make(chan struct{})}
+	go sess.daemon()
+	return sess, nil
+}
+
+// current 当前 session
+func (c *client) current() *session {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.sess
+}
+
+// connect .
+func (c *client) connect() error {
+	sess, err := c.dial()
 	if err != nil {
 		return err
 	}
+	c.sess = sess
 
-	c.actived = true
+	c.actived.Store(true)
+	c.healthy.Store(true)
+	c.opts.NotifyConnected()
 
-	go c.daemon()
+	go c.monitor()
 	return nil
 }
 
-// daemon .
-func (c *client) daemon() {
+// monitor 定期检查连接。连接断开时重建 session, 订阅在新的 session 上恢复
+func (c *client) monitor() {
+	t := time.NewTicker(c.opts.ReconnectWait)
+	defer t.Stop()
+
 	for {
 		select {
 		case <-c.closing:
-			c.producer.Close()
 			return
-		case err, ok := <-c.producer.Errors():
-			if ok {
-				logger.Errorf(`[kafka]: produce["%s"]: %v`, err.Msg.Topic, err.Err)
+		case <-t.C:
+		}
+
+		if err := c.current().client.RefreshMetadata(); err != nil {
+			logger.Errorf(`[kafka]: disconnected: %v`, err)
+
+			c.healthy.Store(false)
+			c.opts.NotifyDisconnected(err)
+
+			if !c.reconnect() {
+				return
 			}
 		}
 	}
 }
 
-// piblish .
-func (c *client) publish(topic string, v interface{}, opts ...func(o *broker.PublishOptions)) error {
-	if !c.actived {
+// reconnect 按 Options.ReconnectBackoff 重建 session。client 关闭时返回 false
+func (c *client) reconnect() bool {
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-c.closing:
+			return false
+		case <-time.After(c.opts.ReconnectBackoff(attempt)):
+		}
+
+		sess, err := c.dial()
+		if err != nil {
+			logger.Errorf(`[kafka]: reconnect: attempts: %d: %v`, attempt, err)
+			continue
+		}
+
+		c.lock.Lock()
+		select {
+		case <-c.closing:
+			c.lock.Unlock()
+			sess.close()
+			return false
+		default:
+		}
+		old := c.sess
+		c.sess = sess
+		c.lock.Unlock()
+
+		old.close()
+
+		logger.Debugf(`[kafka]: reconnected`)
+
+		c.healthy.Store(true)
+		c.opts.NotifyReconnected()
+		return true
+	}
+}
+
+// acked 记录发布结果, 并通知同步发布的结果
+func acked(msg *sarama.ProducerMessage, err error) {
+	broker.ObservePublish(msg.Topic, err)
+
+	if result, ok := msg.Metadata.(chan error); ok && result != nil {
+		result <- err
+	}
+}
+
+// recordHeaders broker.Header to []sarama.RecordHeader
+func recordHeaders(h broker.Header) []sarama.RecordHeader {
+	var out = make([]sarama.RecordHeader, 0, len(h))
+	for key, val := range h {
+		out = append(out, sarama.RecordHeader{Key: []byte(key), Value: []byte(val)})
+	}
+	return out
+}
+
+// brokerHeader []*sarama.RecordHeader to broker.Header
+func brokerHeader(h []*sarama.RecordHeader) broker.Header {
+	var out = make(broker.Header, len(h))
+	for _, item := range h {
+		if item != nil {
+			out.Set(string(item.Key), string(item.Value))
+		}
+	}
+	return out
+}
+
+// produce 发送消息。消息头中存在 broker.HeaderKey 时, 按 key 分区; result 不为空时, 发送结果写入 result
+func (c *client) produce(topic string, data []byte, header broker.Header, result chan error) *sarama.ProducerMessage {
+	var msg = &sarama.ProducerMessage{
+		Topic:   topic,
+		Value:   sarama.ByteEncoder(data),
+		Headers: recordHeaders(header),
+	}
+	if key := header.Get(broker.HeaderKey); len(key) != 0 {
+		msg.Key = sarama.StringEncoder(key)
+	}
+	if result != nil {
+		msg.Metadata = result
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	// client 已关闭
+	if c.sess.closed() {
+		acked(msg, broker.ErrNotReady)
+		return msg
+	}
+
+	c.sess.producer.Input() <- msg
+	return msg
+}
+
+// prepare 检查发布条件
+func (c *client) prepare(topic string, o *broker.PublishOptions) error {
+	if !c.actived.Load() {
 		return broker.ErrNotReady
 	}
 
-	if err := broker.CheckSubject(topic); err != nil {
-		return err
+	if o.Delayed() {
+		return broker.ErrDelayNotSupported
 	}
 
-	var o = broker.ParsePublishOptions(opts...)
-
-	var data []byte
-	var err error
-	switch o.Codec.ContentType() {
-	case content.Json:
-		data, err = o.Codec.Marshal(
-			&broker.JsonMessage{
-				ID:        uuid.NewString(),
-				Producer:  c.id,
-				CreatedAt: library.NowString(),
-				Data:      v,
-			},
-		)
-	case content.Proto:
-		data, err = o.Codec.Marshal(v)
-	default:
-		err = errors.Errorf("unsupported content-type of %s.", o.Codec.ContentType().String())
+	return broker.CheckSubject(topic)
+}
+
+// marshal .
+func (c *client) marshal(topic string, v interface{}, o *broker.PublishOptions) ([]byte, error) {
+	if err := c.prepare(topic, o); err != nil {
+		return nil, err
 	}
 
+	return broker.Marshal(c.id, v, o.Codec)
+}
+
+// piblish .
+func (c *client) publish(topic string, v interface{}, o *broker.PublishOptions) error {
+	data, err := c.marshal(topic, v, o)
 	if err != nil {
+		broker.ObservePublish(topic, err)
 		return err
 	}
 
-	c.producer.Input() <- &sarama.ProducerMessage{
-		Topic: topic,
-		Value: sarama.ByteEncoder(data),
-	}
+	c.produce(topic, data, broker.Inject(o.Context, o.Header), nil)
 
 	logger.CallerSkip(o.CallerSkip+1).Context(o.Context).Debugf(`[kafka]: publish["%s"]: %s`, topic, o.Codec.RawMessage(data))
 	return nil
@@ -155,71 +436,387 @@ func (c *client) publish(topic string, v interface{}, opts ...func(o *broker.Pub
 
 // Publish .
 func (c *client) Publish(topic string, v interface{}, opts ...func(o *broker.PublishOptions)) error {
-	return errors.Wrapf(c.publish(topic, v, opts...), `[kafka]: publish["%s"]`, topic)
+	return errors.Wrapf(c.publish(topic, v, broker.ParsePublishOptions(opts...)), `[kafka]: publish["%s"]`, topic)
+}
+
+// publishSync .
+func (c *client) publishSync(topic string, v interface{}, o *broker.PublishOptions) (*broker.Receipt, error) {
+	data, err := c.marshal(topic, v, o)
+	if err != nil {
+		broker.ObservePublish(topic, err)
+		return nil, err
+	}
+
+	var result = make(chan error, 1)
+	var msg = c.produce(topic, data, broker.Inject(o.Context, o.Header), result)
+
+	select {
+	case err := <-result:
+		if err != nil {
+			return nil, err
+		}
+
+		logger.CallerSkip(o.CallerSkip+1).Context(o.Context).Debugf(`[kafka]: publish["%s"]: partition: %d, offset: %d: %s`, topic, msg.Partition, msg.Offset, o.Codec.RawMessage(data))
+		return &broker.Receipt{Topic: topic, Partition: msg.Partition, Offset: msg.Offset}, nil
+	case <-c.closing:
+		return nil, broker.ErrNotReady
+	case <-time.NewTimer(o.Timeout).C:
+		return nil, broker.ErrPublishTimeout
+	}
+}
+
+// PublishSync .
+func (c *client) PublishSync(topic string, v interface{}, opts ...func(o *broker.PublishOptions)) (*broker.Receipt, error) {
+	receipt, err := c.publishSync(topic, v, broker.ParsePublishOptions(opts...))
+	return receipt, errors.Wrapf(err, `[kafka]: publish["%s"]`, topic)
+}
+
+// publishBatch 全部消息交由 producer 批量发送后统一等待结果
+func (c *client) publishBatch(topic string, vs []interface{}, o *broker.PublishOptions) ([]broker.Result, error) {
+	if err := c.prepare(topic, o); err != nil {
+		return nil, err
+	}
+
+	var header = broker.Inject(o.Context, o.Header)
+	var results = make([]broker.Result, len(vs))
+	var msgs = make([]*sarama.ProducerMessage, len(vs))
+	var acks = make([]chan error, len(vs))
+
+	for i, v := range vs {
+		data, err := broker.Marshal(c.id, v, o.Codec)
+		if err != nil {
+			broker.ObservePublish(topic, err)
+			results[i].Err = err
+			continue
+		}
+
+		acks[i] = make(chan error, 1)
+		msgs[i] = c.produce(topic, data, header, acks[i])
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), o.Timeout)
+	defer cancel()
+
+	var failed int
+	for i, ack := range acks {
+		if ack != nil {
+			select {
+			case err := <-ack:
+				if err != nil {
+					results[i].Err = err
+				} else {
+					results[i].Receipt = &broker.Receipt{Topic: topic, Partition: msgs[i].Partition, Offset: msgs[i].Offset}
+				}
+			case <-c.closing:
+				results[i].Err = broker.ErrNotReady
+			case <-ctx.Done():
+				results[i].Err = broker.ErrPublishTimeout
+			}
+		}
+
+		if results[i].Err != nil {
+			failed++
+		}
+	}
+
+	logger.CallerSkip(o.CallerSkip+1).Context(o.Context).Debugf(`[kafka]: publish["%s"]: batch: %d, failed: %d`, topic, len(vs), failed)
+	return results, nil
+}
+
+// PublishBatch .
+func (c *client) PublishBatch(topic string, vs []interface{}, opts ...func(o *broker.PublishOptions)) ([]broker.Result, error) {
+	results, err := c.publishBatch(topic, vs, broker.ParsePublishOptions(opts...))
+	return results, errors.Wrapf(err, `[kafka]: publish["%s"]`, topic)
+}
+
+// subscription 每个订阅使用独立的 consumer group
+type subscription struct {
+	topic string
+
+	cancel   context.CancelFunc
+	draining bool
+	closing  chan struct{}
+	closed   chan struct{}
+	once     sync.Once
+
+	dispatcher *broker.Dispatcher
+}
+
+// Topic .
+func (s *subscription) Topic() string {
+	return s.topic
+}
+
+// stop .
+func (s *subscription) stop(drain bool) {
+	s.once.Do(func() {
+		s.draining = drain
+		close(s.closing)
+
+		if !drain {
+			s.cancel()
+		}
+	})
+	<-s.closed
+}
+
+// Unsubscribe .
+func (s *subscription) Unsubscribe() error {
+	logger.Debugf(`[kafka]: unsubscribe["%s"]`, s.topic)
+
+	s.stop(false)
+	return nil
+}
+
+// Drain .
+func (s *subscription) Drain() error {
+	logger.Debugf(`[kafka]: drain["%s"]`, s.topic)
+
+	s.stop(true)
+	return nil
+}
+
+// seek 设置 consumer group 的起始 offset。仅作用于没有提交过 offset 的分区
+func (c *client) seek(group, topic string, o *broker.SubscribeOptions) error {
+	var position int64
+	switch o.Start {
+	case broker.StartDefault, broker.StartLatest:
+		// sarama.Config.Consumer.Offsets.Initial
+		return nil
+	case broker.StartEarliest:
+		position = sarama.OffsetOldest
+	case broker.StartAtTime:
+		position = o.StartTime.UnixMilli()
+	case broker.StartAtSequence:
+	default:
+		return broker.ErrStartNotSupported
+	}
+
+	var sess = c.current()
+
+	partitions, err := sess.client.Partitions(topic)
+	if err != nil {
+		// topic 不存在, 从第一条消息开始消费即可
+		if errors.Is(err, sarama.ErrUnknownTopicOrPartition) {
+			return nil
+		}
+		return err
+	}
+
+	om, err := sarama.NewOffsetManagerFromClient(group, sess.client)
+	if err != nil {
+		return err
+	}
+	// 提交标记的 offset
+	defer om.Close()
+
+	for _, partition := range partitions {
+		pom, err := om.ManagePartition(topic, partition)
+		if err != nil {
+			return err
+		}
+
+		if next, _ := pom.NextOffset(); next >= 0 {
+			continue
+		}
+
+		var offset = o.StartSequence
+		if o.Start != broker.StartAtSequence {
+			if offset, err = sess.client.GetOffset(topic, partition, position); err != nil {
+				return err
+			}
+
+			// StartTime 之后没有消息
+			if offset < 0 {
+				if offset, err = sess.client.GetOffset(topic, partition, sarama.OffsetNewest); err != nil {
+					return err
+				}
+			}
+		}
+
+		pom.MarkOffset(offset, "")
+	}
+	return nil
+}
+
+// deleteGroup .
+func (c *client) deleteGroup(group string) {
+	// ClusterAdmin.Close 会关闭 client, 此处不关闭
+	admin, err := sarama.NewClusterAdminFromClient(c.current().client)
+	if err == nil {
+		err = admin.DeleteConsumerGroup(group)
+	}
+	if err != nil {
+		logger.Errorf(`[kafka]: delete consumer group["%s"]: %v`, group, err)
+	}
 }
 
 // subscribe .
-func (c *client) subscribe(topic string, handler broker.Handler, opts ...func(o *broker.SubscribeOptions)) error {
-	if !c.actived {
-		return broker.ErrNotReady
+func (c *client) subscribe(topic string, handler broker.Handler, opts ...func(o *broker.SubscribeOptions)) (broker.Subscription, error) {
+	if !c.actived.Load() {
+		return nil, broker.ErrNotReady
 	}
 
 	if err := broker.CheckSubject(topic); err != nil {
-		return err
+		return nil, err
 	}
 
 	logger.Debugf(`[kafka]: subscribe["%s"]`, topic)
 
 	var o = broker.ParseSubscribeOptions(opts...)
+	var group = o.ConsumerModel(c.id, topic)
+
+	if err := c.seek(group, topic, o); err != nil {
+		return nil, err
+	}
+
+	var sess = c.current()
+
+	consumer, err := sarama.NewConsumerGroupFromClient(group, sess.client)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(o.Context)
+	o.Context = ctx
+
+	sub := &subscription{
+		topic:   topic,
+		cancel:  cancel,
+		closing: make(chan struct{}),
+		closed:  make(chan struct{}),
+
+		dispatcher: broker.NewDispatcher(o),
+	}
 
 	go func() {
+		defer close(sub.closed)
+		defer cancel()
+
 		t := time.NewTicker(c.opts.ReconnectWait)
+		defer t.Stop()
 
-		consumer, err := sarama.NewConsumerGroupFromClient(o.ConsumerModel(c.id, topic), c.client)
-		if err != nil {
-			logger.Errorf(`[kafka]: subscribe["%s"]: %v`, err)
-			return
+		// wait 等待重试。订阅或 client 关闭时返回 false
+		var wait = func() bool {
+			select {
+			case <-t.C:
+				return true
+			case <-sub.closing:
+				return false
+			case <-c.closing:
+				return false
+			}
 		}
 
-		consumerGroupHandler := &consumerGroup{client: c, h: handler, opts: o}
+		consumerGroupHandler := &consumerGroup{client: c, sub: sub, group: group, h: broker.WrapHandler(handler, c.opts, o), opts: o}
 		for {
-			err := consumer.Consume(o.Context, []string{topic}, consumerGroupHandler)
+			// session 关闭时结束本次消费
+			consume, stop := context.WithCancel(o.Context)
+			go func(closing chan struct{}) {
+				select {
+				case <-closing:
+				case <-consume.Done():
+				}
+				stop()
+			}(sess.closing)
+
+			err := consumer.Consume(consume, []string{topic}, consumerGroupHandler)
+			stop()
+
 			select {
 			case <-c.closing:
 				consumer.Close()
 				return
+			case <-sub.closing:
+				consumer.Close()
+
+				// 删除临时消费者的 consumer group
+				if o.Ephemeral {
+					c.deleteGroup(group)
+				}
+				return
+			case <-sess.closing:
+				consumer.Close()
+
+				// 在重建的 session 上恢复订阅
+				for {
+					sess = c.current()
+					if consumer, err = sarama.NewConsumerGroupFromClient(group, sess.client); err == nil {
+						break
+					}
+
+					logger.Errorf(`[kafka]: resubscribe["%s"]: %v`, topic, err)
+					if !wait() {
+						return
+					}
+				}
 			default:
 				if err != nil {
 					logger.Errorf(`[kafka]: consume["%s"]: %v`, topic, err)
 				}
-				<-t.C
+
+				// 订阅或 client 关闭时, 由下一次循环处理
+				wait()
 			}
 		}
 	}()
 
-	return nil
+	return sub, nil
 }
 
 // Subscribe .
-func (c *client) Subscribe(topic string, handler broker.Handler, opts ...func(o *broker.SubscribeOptions)) error {
-	return errors.Wrapf(c.subscribe(topic, handler, opts...), `[kafka]: subscribe["%s"]`, topic)
+func (c *client) Subscribe(topic string, handler broker.Handler, opts ...func(o *broker.SubscribeOptions)) (broker.Subscription, error) {
+	sub, err := c.subscribe(topic, handler, opts...)
+	return sub, errors.Wrapf(err, `[kafka]: subscribe["%s"]`, topic)
+}
+
+// Healthy 连接断开后至重连成功前返回 false
+func (c *client) Healthy() bool {
+	return c.actived.Load() && c.healthy.Load()
 }
 
 // Close .
 func (c *client) Close() {
-	if c.actived {
-		c.actived = false
-
+	if c.actived.CompareAndSwap(true, false) {
 		close(c.closing)
-		c.client.Close()
+
+		c.lock.Lock()
+		c.sess.close()
+		c.lock.Unlock()
+	}
+}
+
+// security SASL 与 TLS 配置
+func (c *client) security() error {
+	if len(c.opts.SASLMechanism) != 0 {
+		mechanism := sarama.SASLMechanism(strings.ToUpper(c.opts.SASLMechanism))
+
+		c.conf.Net.SASL.Enable = true
+		c.conf.Net.SASL.Handshake = true
+		c.conf.Net.SASL.Mechanism = mechanism
+		c.conf.Net.SASL.User = c.opts.Username
+		c.conf.Net.SASL.Password = c.opts.Password
+		c.conf.Net.SASL.SCRAMClientGeneratorFunc = newSCRAMClientGenerator(mechanism)
+	}
+
+	if c.opts.TLS != nil {
+		conf, err := c.opts.TLS.Config()
+		if err != nil {
+			return err
+		}
+
+		c.conf.Net.TLS.Enable = true
+		c.conf.Net.TLS.Config = conf
 	}
+	return nil
 }
 
 // NewClient .
 func NewClient(id string, opts ...func(o *broker.Options)) (broker.Client, error) {
 	c := &client{id: id, opts: broker.ParseOptions(opts...), closing: make(chan struct{})}
+	c.replies = newReplies(id, c.opts.ReplyTopic)
 
-	if len(c.opts.Address) == 0 {
+	if len(c.opts.Addresses()) == 0 {
 		return nil, broker.ErrInvalidAddrs
 	}
 
@@ -234,9 +831,13 @@ func NewClient(id string, opts ...func(o *broker.Options)) (broker.Client, error
 	c.conf.Consumer.Offsets.AutoCommit.Enable = true
 
 	c.conf.Producer.Return.Errors = true
-	c.conf.Producer.Return.Successes = false
+	c.conf.Producer.Return.Successes = true
 	c.conf.Producer.RequiredAcks = sarama.WaitForAll
-	c.conf.Producer.Partitioner = sarama.NewRandomPartitioner
+	c.conf.Producer.Partitioner = sarama.NewHashPartitioner
+
+	if err := c.security(); err != nil {
+		return nil, err
+	}
 
 	return c, c.connect()
 }
@@ -2,10 +2,14 @@ package kafka
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/IBM/sarama"
 	"github.com/google/uuid"
 
 	"github.com/charlesbases/logger"
@@ -26,7 +30,7 @@ func Test(t *testing.T) {
 	var topic = "ticker"
 
 	// Subscribe
-	c.Subscribe(topic, func(event broker.Event) error {
+	c.Subscribe(topic, func(ctx context.Context, event broker.Event) error {
 		var timestr string
 		if err := event.Unmarshal(&timestr); err != nil {
 			return err
@@ -48,3 +52,138 @@ func Test(t *testing.T) {
 
 	<-time.NewTimer(time.Minute).C
 }
+
+// testSession 记录提交的 offset
+type testSession struct {
+	sarama.ConsumerGroupSession
+
+	lock   sync.Mutex
+	offset int64
+}
+
+// MarkOffset .
+func (s *testSession) MarkOffset(topic string, partition int32, offset int64, metadata string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if offset > s.offset {
+		s.offset = offset
+	}
+}
+
+// committed .
+func (s *testSession) committed() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.offset
+}
+
+// testClaim .
+type testClaim struct {
+	sarama.ConsumerGroupClaim
+
+	topic    string
+	messages chan *sarama.ConsumerMessage
+}
+
+// Topic .
+func (c *testClaim) Topic() string {
+	return c.topic
+}
+
+// Partition .
+func (c *testClaim) Partition() int32 {
+	return 0
+}
+
+// HighWaterMarkOffset .
+func (c *testClaim) HighWaterMarkOffset() int64 {
+	return int64(cap(c.messages))
+}
+
+// Messages .
+func (c *testClaim) Messages() <-chan *sarama.ConsumerMessage {
+	return c.messages
+}
+
+func TestRedeliver(t *testing.T) {
+	var topic = "redeliver"
+
+	var lock sync.Mutex
+	var attempts = make(map[string]int)
+
+	var once sync.Once
+	var succeeded = make(chan struct{})
+
+	// offset 0 在 offset 1 处理成功后失败
+	var handler = func(ctx context.Context, event broker.Event) error {
+		lock.Lock()
+		attempts[event.Key()]++
+		var attempt = attempts[event.Key()]
+		lock.Unlock()
+
+		switch event.Key() {
+		case "0":
+			if attempt == 1 {
+				<-succeeded
+				return errors.New("failed")
+			}
+		case "1":
+			once.Do(func() { close(succeeded) })
+		}
+		return nil
+	}
+
+	// client 未连接, 死信发布失败, 消息 nack
+	var o = broker.ParseSubscribeOptions(func(o *broker.SubscribeOptions) {
+		o.Concurrency = 2
+		o.DeadLetter = "redeliver.dead"
+	})
+	var sub = &subscription{topic: topic, closing: make(chan struct{}), closed: make(chan struct{}), dispatcher: broker.NewDispatcher(o)}
+	var group = &consumerGroup{client: &client{id: "test", closing: make(chan struct{})}, sub: sub, group: topic, opts: o, h: handler}
+
+	var session = new(testSession)
+
+	// consume 从已提交的 offset 开始投递消息。eof 为 true 时, 投递完成后等待消息处理完成
+	var consume = func(eof bool) error {
+		var claim = &testClaim{topic: topic, messages: make(chan *sarama.ConsumerMessage, 2)}
+		for offset := session.committed(); offset < 2; offset++ {
+			claim.messages <- &sarama.ConsumerMessage{Topic: topic, Offset: offset, Key: []byte(strconv.FormatInt(offset, 10)), Value: []byte("null")}
+		}
+		if eof {
+			defer sub.dispatcher.Wait()
+			close(claim.messages)
+		}
+
+		var done = make(chan error, 1)
+		go func() {
+			done <- group.ConsumeClaim(session, claim)
+		}()
+
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(time.Second * 5):
+			return errors.New("consume claim: timeout")
+		}
+	}
+
+	// offset 0 失败后停止消费, offset 1 虽已成功也不提交
+	if err := consume(false); err != nil {
+		t.Fatal(err)
+	}
+	if offset := session.committed(); offset != 0 {
+		t.Fatalf("committed: %d, expected: 0", offset)
+	}
+
+	// 重新投递 offset 0
+	if err := consume(true); err != nil {
+		t.Fatal(err)
+	}
+	if offset := session.committed(); offset != 2 {
+		t.Fatalf("committed: %d, expected: 2", offset)
+	}
+	if attempts["0"] != 2 {
+		t.Fatalf("offset 0 attempts: %d, expected: 2", attempts["0"])
+	}
+}
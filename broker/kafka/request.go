@@ -0,0 +1,244 @@
+package kafka
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/charlesbases/logger"
+
+	"github.com/charlesbases/library/broker"
+)
+
+const (
+	// defaultReplyReplicas 应答 topic 的最大副本数
+	defaultReplyReplicas = 3
+	// defaultReplyRetention 应答 topic 的消息保留时间
+	defaultReplyRetention = time.Hour
+)
+
+// replies 请求应答。应答 topic 可由同一服务的多个副本共享, 每个副本监听全部分区, 通过 Correlation-ID 匹配请求
+type replies struct {
+	topic string
+	// sess 正在监听应答 topic 的 session
+	sess *session
+
+	pending map[string]chan *sarama.ConsumerMessage
+
+	pendingLock sync.Mutex
+	listenLock  sync.Mutex
+}
+
+// newReplies topic 为空时使用 "<id>.reply"
+func newReplies(id string, topic string) *replies {
+	if len(topic) == 0 {
+		topic = strings.Join([]string{id, "reply"}, ".")
+	}
+
+	return &replies{
+		topic:   topic,
+		pending: make(map[string]chan *sarama.ConsumerMessage),
+	}
+}
+
+// wait .
+func (r *replies) wait(correlation string) chan *sarama.ConsumerMessage {
+	var c = make(chan *sarama.ConsumerMessage, 1)
+
+	r.pendingLock.Lock()
+	r.pending[correlation] = c
+	r.pendingLock.Unlock()
+	return c
+}
+
+// done .
+func (r *replies) done(correlation string) {
+	r.pendingLock.Lock()
+	delete(r.pending, correlation)
+	r.pendingLock.Unlock()
+}
+
+// deliver .
+func (r *replies) deliver(message *sarama.ConsumerMessage) {
+	var correlation = brokerHeader(message.Headers).Get(broker.HeaderCorrelationID)
+
+	r.pendingLock.Lock()
+	if c, found := r.pending[correlation]; found {
+		select {
+		case c <- message:
+		default:
+		}
+	}
+	r.pendingLock.Unlock()
+}
+
+// orCreateReplyTopic 创建应答 topic, 集群可能关闭了 auto.create.topics.enable
+func (c *client) orCreateReplyTopic(sess *session) error {
+	// ClusterAdmin.Close 会关闭 client, 此处不关闭
+	admin, err := sarama.NewClusterAdminFromClient(sess.client)
+	if err != nil {
+		return err
+	}
+
+	var replicas = int16(len(sess.client.Brokers()))
+	switch {
+	case replicas > defaultReplyReplicas:
+		replicas = defaultReplyReplicas
+	case replicas < 1:
+		replicas = 1
+	}
+
+	var retention = strconv.FormatInt(defaultReplyRetention.Milliseconds(), 10)
+	if err := admin.CreateTopic(
+		c.replies.topic, &sarama.TopicDetail{
+			NumPartitions:     1,
+			ReplicationFactor: replicas,
+			ConfigEntries:     map[string]*string{"retention.ms": &retention},
+		}, false,
+	); err != nil && !errors.Is(err, sarama.ErrTopicAlreadyExists) {
+		return err
+	}
+
+	return sess.client.RefreshMetadata(c.replies.topic)
+}
+
+// listen 监听应答 topic
+func (c *client) listen() error {
+	c.replies.listenLock.Lock()
+	defer c.replies.listenLock.Unlock()
+
+	// 重连后在新的 session 上重新监听
+	var sess = c.current()
+	if c.replies.sess == sess {
+		return nil
+	}
+
+	if err := c.orCreateReplyTopic(sess); err != nil {
+		return err
+	}
+
+	consumer, err := sarama.NewConsumerFromClient(sess.client)
+	if err != nil {
+		return err
+	}
+
+	partitions, err := sess.client.Partitions(c.replies.topic)
+	if err != nil {
+		consumer.Close()
+		return err
+	}
+
+	for _, partition := range partitions {
+		pc, err := consumer.ConsumePartition(c.replies.topic, partition, sarama.OffsetNewest)
+		if err != nil {
+			consumer.Close()
+			return err
+		}
+
+		go func() {
+			for {
+				select {
+				case <-sess.closing:
+					pc.Close()
+					return
+				case message, ok := <-pc.Messages():
+					if !ok {
+						return
+					}
+					c.replies.deliver(message)
+				}
+			}
+		}()
+	}
+
+	go func() {
+		<-sess.closing
+		consumer.Close()
+	}()
+
+	c.replies.sess = sess
+	return nil
+}
+
+// request .
+func (c *client) request(topic string, v interface{}, timeout time.Duration, opts ...func(o *broker.PublishOptions)) (broker.Event, error) {
+	if !c.actived.Load() {
+		return nil, broker.ErrNotReady
+	}
+
+	if err := c.listen(); err != nil {
+		return nil, err
+	}
+
+	var correlation = uuid.NewString()
+	var reply = c.replies.wait(correlation)
+	defer c.replies.done(correlation)
+
+	var o = broker.ParsePublishOptions(opts...)
+	o.Header = o.Header.Clone()
+	o.Header.Set(broker.HeaderReplyTo, c.replies.topic)
+	o.Header.Set(broker.HeaderCorrelationID, correlation)
+
+	if err := c.publish(topic, v, o); err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-c.closing:
+		return nil, broker.ErrNotReady
+	case message := <-reply:
+		logger.Context(o.Context).Debugf(`[kafka]: request["%s"]: reply: %s`, topic, o.Codec.RawMessage(message.Value))
+		return broker.NewEvent(topic, "", message.Value, o.Codec, func(eo *broker.EventOptions) {
+			eo.Context = o.Context
+			eo.Header = brokerHeader(message.Headers)
+		}), nil
+	case <-time.NewTimer(timeout).C:
+		return nil, broker.ErrRequestTimeout
+	}
+}
+
+// Request .
+func (c *client) Request(topic string, v interface{}, timeout time.Duration, opts ...func(o *broker.PublishOptions)) (broker.Event, error) {
+	event, err := c.request(topic, v, timeout, opts...)
+	return event, errors.Wrapf(err, `[kafka]: request["%s"]`, topic)
+}
+
+// responder 应答至请求方的应答 topic
+func (c *client) responder(reply string, correlation string) func(o *broker.EventOptions) {
+	return func(o *broker.EventOptions) {
+		o.Responder = func(v interface{}, opts ...func(o *broker.PublishOptions)) error {
+			var po = broker.ParsePublishOptions(opts...)
+
+			data, err := broker.Marshal(c.id, v, po.Codec)
+			if err != nil {
+				return errors.Wrapf(err, `[kafka]: respond["%s"]`, reply)
+			}
+
+			var header = broker.Inject(po.Context, po.Header)
+			header.Set(broker.HeaderCorrelationID, correlation)
+
+			// 等待发送结果, 发送失败时返回错误
+			var result = make(chan error, 1)
+			c.produce(reply, data, header, result)
+
+			select {
+			case err = <-result:
+			case <-c.closing:
+				err = broker.ErrNotReady
+			case <-time.NewTimer(po.Timeout).C:
+				err = broker.ErrPublishTimeout
+			}
+			if err != nil {
+				return errors.Wrapf(err, `[kafka]: respond["%s"]`, reply)
+			}
+
+			logger.Context(po.Context).Debugf(`[kafka]: respond["%s"]: %s`, reply, po.Codec.RawMessage(data))
+			return nil
+		}
+	}
+}
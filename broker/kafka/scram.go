@@ -0,0 +1,48 @@
+package kafka
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+
+	"github.com/IBM/sarama"
+	"github.com/xdg-go/scram"
+)
+
+// scramClient sarama.SCRAMClient 的实现, 见 sarama examples/sasl_scram_client
+type scramClient struct {
+	*scram.Client
+	*scram.ClientConversation
+	scram.HashGeneratorFcn
+}
+
+// newSCRAMClientGenerator .
+func newSCRAMClientGenerator(mechanism sarama.SASLMechanism) func() sarama.SCRAMClient {
+	switch mechanism {
+	case sarama.SASLTypeSCRAMSHA256:
+		return func() sarama.SCRAMClient { return &scramClient{HashGeneratorFcn: sha256.New} }
+	case sarama.SASLTypeSCRAMSHA512:
+		return func() sarama.SCRAMClient { return &scramClient{HashGeneratorFcn: sha512.New} }
+	default:
+		return nil
+	}
+}
+
+// Begin .
+func (s *scramClient) Begin(username, password, authzID string) (err error) {
+	s.Client, err = s.HashGeneratorFcn.NewClient(username, password, authzID)
+	if err != nil {
+		return err
+	}
+	s.ClientConversation = s.Client.NewConversation()
+	return nil
+}
+
+// Step .
+func (s *scramClient) Step(challenge string) (string, error) {
+	return s.ClientConversation.Step(challenge)
+}
+
+// Done .
+func (s *scramClient) Done() bool {
+	return s.ClientConversation.Done()
+}
@@ -0,0 +1,416 @@
+package memory
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/charlesbases/logger"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/charlesbases/library/broker"
+)
+
+// redeliverDelay handler 未确认的消息重新投递的间隔
+const redeliverDelay = time.Second
+
+// message .
+type message struct {
+	data   []byte
+	header broker.Header
+
+	// reply 请求的应答地址
+	reply string
+	// respond 应答至请求方
+	respond func(data []byte, header broker.Header)
+}
+
+// subscriber .
+type subscriber struct {
+	client *client
+
+	topic string
+	group string
+	opts  *broker.SubscribeOptions
+
+	h broker.Handler
+
+	cancel     context.CancelFunc
+	dispatcher *broker.Dispatcher
+}
+
+// consumerGroup 同一 group 内的订阅者共同消费消息
+type consumerGroup []*subscriber
+
+// client .
+type client struct {
+	id   string
+	opts *broker.Options
+
+	// topics topic -> group -> subscribers
+	topics map[string]map[string]consumerGroup
+	// timers 延迟发布与重新投递的定时器, Close 时停止
+	timers map[*time.Timer]struct{}
+	// pending 执行中的定时任务
+	pending sync.WaitGroup
+
+	actived bool
+	lock    sync.RWMutex
+}
+
+// afterFunc 在 d 后执行 fn。Close 后不再执行
+func (c *client) afterFunc(d time.Duration, fn func()) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.actived {
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(d, func() {
+		c.lock.Lock()
+		delete(c.timers, timer)
+		if !c.actived {
+			c.lock.Unlock()
+			return
+		}
+		c.pending.Add(1)
+		c.lock.Unlock()
+
+		defer c.pending.Done()
+		fn()
+	})
+	c.timers[timer] = struct{}{}
+}
+
+// subscribers 每个 group 随机选择一个订阅者
+func (c *client) subscribers(topic string) ([]*subscriber, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if !c.actived {
+		return nil, broker.ErrNotReady
+	}
+
+	var subs = make([]*subscriber, 0, len(c.topics[topic]))
+	for _, group := range c.topics[topic] {
+		if len(group) != 0 {
+			subs = append(subs, group[rand.Intn(len(group))])
+		}
+	}
+	return subs, nil
+}
+
+// publish .
+func (c *client) publish(topic string, v interface{}, o *broker.PublishOptions, m *message) error {
+	if err := broker.CheckSubject(topic); err != nil {
+		return err
+	}
+
+	subs, err := c.subscribers(topic)
+	if err != nil {
+		return err
+	}
+
+	data, err := broker.Marshal(c.id, v, o.Codec)
+	if err != nil {
+		return err
+	}
+	m.data = data
+	m.header = broker.Inject(o.Context, o.Header)
+
+	logger.CallerSkip(o.CallerSkip+1).Context(o.Context).Debugf(`[memory]: publish["%s"]: %s`, topic, o.Codec.RawMessage(data))
+
+	// 延迟发布, 投递至到期时的订阅者
+	if o.Delayed() {
+		c.afterFunc(time.Until(o.DeliverAt), func() {
+			if subs, err := c.subscribers(topic); err == nil {
+				c.deliver(subs, m)
+			}
+		})
+		return nil
+	}
+
+	c.deliver(subs, m)
+	return nil
+}
+
+// deliver 订阅者达到并发上限时阻塞
+func (c *client) deliver(subs []*subscriber, m *message) {
+	for _, sub := range subs {
+		sub := sub
+		sub.dispatcher.Dispatch(m.header.Get(broker.HeaderKey), func() { sub.consume(m) })
+	}
+}
+
+// Publish .
+func (c *client) Publish(topic string, v interface{}, opts ...func(o *broker.PublishOptions)) error {
+	err := c.publish(topic, v, broker.ParsePublishOptions(opts...), new(message))
+	broker.ObservePublish(topic, err)
+	return errors.Wrapf(err, `[memory]: publish["%s"]`, topic)
+}
+
+// PublishSync 消息在 publish 返回时已投递至订阅者
+func (c *client) PublishSync(topic string, v interface{}, opts ...func(o *broker.PublishOptions)) (*broker.Receipt, error) {
+	err := c.publish(topic, v, broker.ParsePublishOptions(opts...), new(message))
+	broker.ObservePublish(topic, err)
+	if err != nil {
+		return nil, errors.Wrapf(err, `[memory]: publish["%s"]`, topic)
+	}
+	return &broker.Receipt{Topic: topic}, nil
+}
+
+// PublishBatch .
+func (c *client) PublishBatch(topic string, vs []interface{}, opts ...func(o *broker.PublishOptions)) ([]broker.Result, error) {
+	if err := broker.CheckSubject(topic); err != nil {
+		return nil, errors.Wrapf(err, `[memory]: publish["%s"]`, topic)
+	}
+
+	var o = broker.ParsePublishOptions(opts...)
+	var results = make([]broker.Result, len(vs))
+	for i, v := range vs {
+		err := c.publish(topic, v, o, new(message))
+		broker.ObservePublish(topic, err)
+
+		if err != nil {
+			results[i].Err = err
+		} else {
+			results[i].Receipt = &broker.Receipt{Topic: topic}
+		}
+	}
+	return results, nil
+}
+
+// request .
+func (c *client) request(topic string, v interface{}, timeout time.Duration, opts ...func(o *broker.PublishOptions)) (broker.Event, error) {
+	var o = broker.ParsePublishOptions(opts...)
+
+	var reply = make(chan *message, 1)
+	if err := c.publish(
+		topic, v, o, &message{
+			reply: uuid.NewString(),
+			respond: func(data []byte, header broker.Header) {
+				select {
+				case reply <- &message{data: data, header: header}:
+				default:
+				}
+			},
+		},
+	); err != nil {
+		return nil, err
+	}
+
+	select {
+	case m := <-reply:
+		event := broker.NewEvent(topic, "", m.data, o.Codec, func(eo *broker.EventOptions) {
+			eo.Context = o.Context
+			eo.Header = m.header
+		})
+
+		logger.Context(o.Context).Debugf(`[memory]: request["%s"]: reply: %s`, topic, event.Codec().RawMessage(m.data))
+		return event, nil
+	case <-time.NewTimer(timeout).C:
+		return nil, broker.ErrRequestTimeout
+	}
+}
+
+// Request .
+func (c *client) Request(topic string, v interface{}, timeout time.Duration, opts ...func(o *broker.PublishOptions)) (broker.Event, error) {
+	event, err := c.request(topic, v, timeout, opts...)
+	return event, errors.Wrapf(err, `[memory]: request["%s"]`, topic)
+}
+
+// consume .
+func (s *subscriber) consume(m *message) {
+	var event = broker.NewEvent(
+		s.topic, m.reply, m.data, s.opts.Codec, func(eo *broker.EventOptions) {
+			eo.Context = s.opts.Context
+			eo.Header = m.header.Clone()
+		}, s.responder(m),
+	)
+
+	logger.Context(event.Context()).Debugf(`[memory]: consume["%s"]: %s`, s.topic, event.Codec().RawMessage(m.data))
+	ack, err := broker.Retry(s.client, event, s.h, s.opts)
+	if err != nil {
+		logger.Context(event.Context()).Errorf(`[memory]: consume["%s"]: %v`, s.topic, err)
+	}
+
+	// 未确认的消息在 redeliverDelay 后重新投递至该订阅者, 取消订阅后丢弃
+	if !ack && s.opts.Context.Err() == nil {
+		s.client.afterFunc(redeliverDelay, func() {
+			if s.opts.Context.Err() == nil {
+				logger.Context(event.Context()).Debugf(`[memory]: consume["%s"]: redeliver`, s.topic)
+				s.dispatcher.Dispatch(m.header.Get(broker.HeaderKey), func() { s.consume(m) })
+			}
+		})
+	}
+}
+
+// responder .
+func (s *subscriber) responder(m *message) func(o *broker.EventOptions) {
+	return func(o *broker.EventOptions) {
+		if m.respond == nil {
+			return
+		}
+
+		o.Responder = func(v interface{}, opts ...func(o *broker.PublishOptions)) error {
+			var po = broker.ParsePublishOptions(opts...)
+
+			data, err := broker.Marshal(s.client.id, v, po.Codec)
+			if err != nil {
+				return errors.Wrapf(err, `[memory]: respond["%s"]`, m.reply)
+			}
+
+			logger.Context(po.Context).Debugf(`[memory]: respond["%s"]: %s`, m.reply, po.Codec.RawMessage(data))
+			m.respond(data, broker.Inject(po.Context, po.Header))
+			return nil
+		}
+	}
+}
+
+// Topic .
+func (s *subscriber) Topic() string {
+	return s.topic
+}
+
+// remove .
+func (s *subscriber) remove() {
+	s.client.lock.Lock()
+	defer s.client.lock.Unlock()
+
+	if groups, found := s.client.topics[s.topic]; found {
+		var group = groups[s.group]
+		for idx, sub := range group {
+			if sub == s {
+				groups[s.group] = append(group[:idx:idx], group[idx+1:]...)
+				break
+			}
+		}
+
+		if len(groups[s.group]) == 0 {
+			delete(groups, s.group)
+		}
+		if len(groups) == 0 {
+			delete(s.client.topics, s.topic)
+		}
+	}
+}
+
+// Unsubscribe .
+func (s *subscriber) Unsubscribe() error {
+	logger.Debugf(`[memory]: unsubscribe["%s"]`, s.topic)
+
+	s.remove()
+	s.cancel()
+	return nil
+}
+
+// Drain .
+func (s *subscriber) Drain() error {
+	logger.Debugf(`[memory]: drain["%s"]`, s.topic)
+
+	s.remove()
+	s.dispatcher.Wait()
+	s.cancel()
+	return nil
+}
+
+// subscribe .
+func (c *client) subscribe(topic string, handler broker.Handler, opts ...func(o *broker.SubscribeOptions)) (broker.Subscription, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.actived {
+		return nil, broker.ErrNotReady
+	}
+
+	if err := broker.CheckSubject(topic); err != nil {
+		return nil, err
+	}
+
+	logger.Debugf(`[memory]: subscribe["%s"]`, topic)
+
+	var o = broker.ParseSubscribeOptions(opts...)
+
+	ctx, cancel := context.WithCancel(o.Context)
+	o.Context = ctx
+
+	var sub = &subscriber{
+		client: c,
+		topic:  topic,
+		group:  o.ConsumerModel(c.id, topic),
+		opts:   o,
+		h:      broker.WrapHandler(handler, c.opts, o),
+
+		cancel:     cancel,
+		dispatcher: broker.NewDispatcher(o),
+	}
+
+	groups, found := c.topics[topic]
+	if !found {
+		groups = make(map[string]consumerGroup)
+		c.topics[topic] = groups
+	}
+	groups[sub.group] = append(groups[sub.group], sub)
+	return sub, nil
+}
+
+// Subscribe .
+func (c *client) Subscribe(topic string, handler broker.Handler, opts ...func(o *broker.SubscribeOptions)) (broker.Subscription, error) {
+	sub, err := c.subscribe(topic, handler, opts...)
+	return sub, errors.Wrapf(err, `[memory]: subscribe["%s"]`, topic)
+}
+
+// Healthy .
+func (c *client) Healthy() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.actived
+}
+
+// Close 停止延迟发布与重新投递, 取消所有订阅并等待处理中的消息完成
+func (c *client) Close() {
+	c.lock.Lock()
+	if !c.actived {
+		c.lock.Unlock()
+		return
+	}
+	c.actived = false
+
+	for timer := range c.timers {
+		timer.Stop()
+	}
+	c.timers = make(map[*time.Timer]struct{})
+
+	var subs = make([]*subscriber, 0)
+	for _, groups := range c.topics {
+		for _, group := range groups {
+			subs = append(subs, group...)
+		}
+	}
+	c.topics = make(map[string]map[string]consumerGroup)
+	c.lock.Unlock()
+
+	for _, sub := range subs {
+		sub.cancel()
+	}
+	c.pending.Wait()
+	for _, sub := range subs {
+		sub.dispatcher.Wait()
+	}
+}
+
+// NewClient .
+func NewClient(id string, opts ...func(o *broker.Options)) (broker.Client, error) {
+	return &client{
+		id:      id,
+		opts:    broker.ParseOptions(opts...),
+		topics:  make(map[string]map[string]consumerGroup),
+		timers:  make(map[*time.Timer]struct{}),
+		actived: true,
+	}, nil
+}
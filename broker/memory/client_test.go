@@ -0,0 +1,809 @@
+package memory
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/charlesbases/library"
+	"github.com/charlesbases/library/broker"
+	"github.com/charlesbases/library/codec"
+	"github.com/charlesbases/library/codec/cbor"
+	"github.com/charlesbases/library/codec/compress"
+	"github.com/charlesbases/library/codec/encrypt"
+	"github.com/charlesbases/library/codec/json"
+	"github.com/charlesbases/library/codec/msgpack"
+	"github.com/charlesbases/library/codec/proto"
+	"github.com/charlesbases/library/codec/protojson"
+	"github.com/charlesbases/library/metadata"
+)
+
+func TestClient(t *testing.T) {
+	c, err := NewClient("test.memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var topic = "ticker"
+
+	var wg sync.WaitGroup
+	var shared, random int32
+
+	// SharedConsumption: 同一 client 的订阅者属于同一 group, 每条消息只消费一次
+	for i := 0; i < 2; i++ {
+		c.Subscribe(topic, func(ctx context.Context, event broker.Event) error {
+			defer wg.Done()
+
+			var v string
+			if err := event.Unmarshal(&v); err != nil {
+				t.Error(err)
+			}
+			atomic.AddInt32(&shared, 1)
+			return nil
+		})
+	}
+
+	// RandomConsumption
+	c.Subscribe(topic, func(ctx context.Context, event broker.Event) error {
+		defer wg.Done()
+
+		atomic.AddInt32(&random, 1)
+		return nil
+	}, func(o *broker.SubscribeOptions) {
+		o.ConsumerModel = broker.RandomConsumption
+	})
+
+	var count = 10
+	wg.Add(count * 2)
+	for i := 0; i < count; i++ {
+		if err := c.Publish(topic, time.Now().String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+
+	if shared != int32(count) || random != int32(count) {
+		t.Fatalf("shared: %d, random: %d, expected: %d", shared, random, count)
+	}
+}
+
+func TestPublishSync(t *testing.T) {
+	c, err := NewClient("test.memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var topic = "sync"
+
+	var received = make(chan struct{}, 1)
+	c.Subscribe(topic, func(ctx context.Context, event broker.Event) error {
+		received <- struct{}{}
+		return nil
+	})
+
+	receipt, err := c.PublishSync(topic, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt.Topic != topic {
+		t.Fatalf("unexpected receipt: %+v", receipt)
+	}
+
+	select {
+	case <-received:
+	case <-time.NewTimer(time.Second).C:
+		t.Fatal("consume timeout")
+	}
+}
+
+func TestOrdered(t *testing.T) {
+	c, err := NewClient("test.memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var topic = "ordered"
+	var keys = []string{"a", "b", "c"}
+	var count = 20
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var got = make(map[string][]int)
+
+	c.Subscribe(topic, func(ctx context.Context, event broker.Event) error {
+		defer wg.Done()
+
+		var v int
+		if err := event.Unmarshal(&v); err != nil {
+			return err
+		}
+
+		// 打乱处理耗时, 顺序仅由 key 保证
+		time.Sleep(time.Duration(count-v) * time.Millisecond)
+
+		lock.Lock()
+		got[event.Key()] = append(got[event.Key()], v)
+		lock.Unlock()
+		return nil
+	}, func(o *broker.SubscribeOptions) {
+		o.Ordered = true
+	})
+
+	wg.Add(count * len(keys))
+	for i := 0; i < count; i++ {
+		for _, key := range keys {
+			key := key
+			c.Publish(topic, i, func(o *broker.PublishOptions) {
+				o.Key = key
+			})
+		}
+	}
+	wg.Wait()
+
+	for _, key := range keys {
+		if len(got[key]) != count {
+			t.Fatalf("key: %s, received: %d, expected: %d", key, len(got[key]), count)
+		}
+		for i, v := range got[key] {
+			if v != i {
+				t.Fatalf("key: %s, unexpected order: %v", key, got[key])
+			}
+		}
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	c, err := NewClient("test.memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var topic = "concurrency"
+	var limit, count = 2, 10
+
+	var wg sync.WaitGroup
+	var running, peak int32
+
+	c.Subscribe(topic, func(ctx context.Context, event broker.Event) error {
+		defer wg.Done()
+
+		n := atomic.AddInt32(&running, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return nil
+	}, func(o *broker.SubscribeOptions) {
+		o.Concurrency = limit
+	})
+
+	wg.Add(count)
+	for i := 0; i < count; i++ {
+		c.Publish(topic, i)
+	}
+	wg.Wait()
+
+	if peak > int32(limit) {
+		t.Fatalf("peak: %d, limit: %d", peak, limit)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	c, err := NewClient("test.memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var topic = "delay"
+
+	var received = make(chan time.Time, 1)
+	c.Subscribe(topic, func(ctx context.Context, event broker.Event) error {
+		received <- time.Now()
+		return nil
+	})
+
+	var start = time.Now()
+	c.Publish(topic, "hello", func(o *broker.PublishOptions) {
+		o.Delay = 100 * time.Millisecond
+	})
+
+	select {
+	case at := <-received:
+		if at.Sub(start) < 100*time.Millisecond {
+			t.Fatalf("delivered after %v", at.Sub(start))
+		}
+	case <-time.NewTimer(time.Second).C:
+		t.Fatal("consume timeout")
+	}
+}
+
+func TestRequest(t *testing.T) {
+	c, err := NewClient("test.memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var topic = "echo"
+
+	c.Subscribe(topic, func(ctx context.Context, event broker.Event) error {
+		var v string
+		if err := event.Unmarshal(&v); err != nil {
+			return err
+		}
+		return event.Respond("echo: " + v)
+	})
+
+	event, err := c.Request(topic, "hello", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var reply string
+	if err := event.Unmarshal(&reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != "echo: hello" {
+		t.Fatalf("unexpected reply: %s", reply)
+	}
+
+	// 无订阅者时请求超时
+	if _, err := c.Request("nobody", "hello", 100*time.Millisecond); errors.Cause(err) != broker.ErrRequestTimeout {
+		t.Fatalf("expected timeout, got: %v", err)
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	c, err := NewClient("test.memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var topic, dlq = "failure", "failure_dlq"
+
+	var attempts int32
+	c.Subscribe(topic, func(ctx context.Context, event broker.Event) error {
+		atomic.AddInt32(&attempts, 1)
+		return errors.New("always failed")
+	}, func(o *broker.SubscribeOptions) {
+		o.MaxAttempts = 3
+		o.Backoff = broker.ConstantBackoff(10 * time.Millisecond)
+		o.DeadLetter = dlq
+	})
+
+	var dead = make(chan *broker.DeadLetterMessage, 1)
+	c.Subscribe(dlq, func(ctx context.Context, event broker.Event) error {
+		var m = new(broker.DeadLetterMessage)
+		if err := event.Unmarshal(m); err != nil {
+			return err
+		}
+		dead <- m
+		return nil
+	})
+
+	c.Publish(topic, "hello")
+
+	select {
+	case m := <-dead:
+		if m.Topic != topic || m.Attempts != 3 || m.Reason != "always failed" || atomic.LoadInt32(&attempts) != 3 {
+			t.Fatalf("unexpected dead letter: %+v", m)
+		}
+	case <-time.NewTimer(time.Second).C:
+		t.Fatal("dead letter timeout")
+	}
+}
+
+func TestRedeliver(t *testing.T) {
+	c, err := NewClient("test.memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var topic = "redeliver"
+
+	var attempts int32
+	var done = make(chan struct{})
+	c.Subscribe(topic, func(ctx context.Context, event broker.Event) error {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			return broker.ErrRedeliver
+		}
+		close(done)
+		return nil
+	}, func(o *broker.SubscribeOptions) {
+		o.MaxAttempts = 1
+	})
+
+	c.Publish(topic, "hello")
+
+	select {
+	case <-done:
+		if atomic.LoadInt32(&attempts) != 2 {
+			t.Fatalf("attempts: %d, expected: 2", attempts)
+		}
+	case <-time.NewTimer(3 * redeliverDelay).C:
+		t.Fatal("redeliver timeout")
+	}
+}
+
+func TestClose(t *testing.T) {
+	c, err := NewClient("test.memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var topic = "close"
+
+	var received = make(chan struct{}, 1)
+	var finished, delayed int32
+	c.Subscribe(topic, func(ctx context.Context, event broker.Event) error {
+		var v string
+		if err := event.Unmarshal(&v); err != nil {
+			return err
+		}
+		if v == "delayed" {
+			atomic.AddInt32(&delayed, 1)
+			return nil
+		}
+
+		received <- struct{}{}
+		<-ctx.Done()
+		atomic.AddInt32(&finished, 1)
+		return nil
+	})
+
+	c.Publish(topic, "delayed", func(o *broker.PublishOptions) {
+		o.Delay = 200 * time.Millisecond
+	})
+	c.Publish(topic, "blocking")
+	<-received
+
+	// Close 取消订阅者的 context, 并等待处理中的消息完成
+	c.Close()
+	if atomic.LoadInt32(&finished) != 1 {
+		t.Fatal("close returned before handler finished")
+	}
+
+	time.Sleep(400 * time.Millisecond)
+	if atomic.LoadInt32(&delayed) != 0 {
+		t.Fatal("delayed message delivered after close")
+	}
+}
+
+func TestHeader(t *testing.T) {
+	c, err := NewClient("test.memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var topic = "header"
+
+	var received = make(chan broker.Event, 1)
+	c.Subscribe(topic, func(ctx context.Context, event broker.Event) error {
+		received <- event
+		return nil
+	})
+
+	var ctx = context.WithValue(context.Background(), library.HeaderTraceID, "trace")
+	ctx = metadata.Metadata{"tenant": 1}.WithContext(ctx)
+
+	c.Publish(topic, "hello", func(o *broker.PublishOptions) {
+		o.Context = ctx
+		o.Header = broker.Header{"key": "val"}
+	})
+
+	select {
+	case event := <-received:
+		if event.Header().Get("key") != "val" || event.Header().Get(library.HeaderTraceID) != "trace" {
+			t.Fatalf("unexpected header: %v", event.Header())
+		}
+		if event.Context().Value(library.HeaderTraceID) != "trace" || metadata.String(event.Context(), "tenant") != "1" {
+			t.Fatal("metadata was not extracted into event context")
+		}
+	case <-time.NewTimer(time.Second).C:
+		t.Fatal("consume timeout")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var order = make(chan string, 4)
+	var trace = func(name string) broker.Middleware {
+		return func(next broker.Handler) broker.Handler {
+			return func(ctx context.Context, event broker.Event) error {
+				order <- name
+				return next(ctx, event)
+			}
+		}
+	}
+
+	c, err := NewClient("test.memory", func(o *broker.Options) {
+		o.Middlewares = []broker.Middleware{trace("client")}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var topic = "panic"
+
+	var dead = make(chan *broker.DeadLetterMessage, 1)
+	c.Subscribe(topic+"_dlq", func(ctx context.Context, event broker.Event) error {
+		var m = new(broker.DeadLetterMessage)
+		if err := event.Unmarshal(m); err != nil {
+			return err
+		}
+		dead <- m
+		return nil
+	})
+
+	c.Subscribe(topic, func(ctx context.Context, event broker.Event) error {
+		panic("oops")
+	}, func(o *broker.SubscribeOptions) {
+		o.DeadLetter = topic + "_dlq"
+		o.Middlewares = []broker.Middleware{trace("subscription")}
+	})
+
+	c.Publish(topic, "hello")
+
+	select {
+	case m := <-dead:
+		if !strings.HasPrefix(m.Reason, "panic: oops") {
+			t.Fatalf("unexpected reason: %s", m.Reason)
+		}
+	case <-time.NewTimer(time.Second).C:
+		t.Fatal("dead letter timeout")
+	}
+
+	// dead letter handler 同样经过 client 中间件
+	var got []string
+	for len(order) != 0 {
+		got = append(got, <-order)
+	}
+	if len(got) != 3 || got[0] != "client" || got[1] != "subscription" || got[2] != "client" {
+		t.Fatalf("unexpected middleware order: %v", got)
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	c, err := NewClient("test.memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var topic = "unsubscribe"
+
+	var count int32
+	sub, err := c.Subscribe(topic, func(ctx context.Context, event broker.Event) error {
+		time.Sleep(50 * time.Millisecond)
+		atomic.AddInt32(&count, 1)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.Topic() != topic {
+		t.Fatalf("unexpected topic: %s", sub.Topic())
+	}
+
+	c.Publish(topic, "hello")
+
+	// Drain 等待已接收的消息处理完成
+	if err := sub.Drain(); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&count) != 1 {
+		t.Fatal("drain returned before the handler finished")
+	}
+
+	c.Publish(topic, "hello")
+	time.Sleep(100 * time.Millisecond)
+
+	if atomic.LoadInt32(&count) != 1 {
+		t.Fatal("message received after drain")
+	}
+}
+
+func TestEphemeral(t *testing.T) {
+	c, err := NewClient("test.memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var topic = "ephemeral"
+
+	var shared, ephemeral int32
+	c.Subscribe(topic, func(ctx context.Context, event broker.Event) error {
+		atomic.AddInt32(&shared, 1)
+		return nil
+	})
+
+	// 临时消费者使用独立的 consumer group, 与同组的订阅者各自接收消息
+	sub, err := c.Subscribe(topic, func(ctx context.Context, event broker.Event) error {
+		atomic.AddInt32(&ephemeral, 1)
+		return nil
+	}, func(o *broker.SubscribeOptions) {
+		o.Ephemeral = true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+
+	for i := 0; i < 10; i++ {
+		c.Publish(topic, i)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if atomic.LoadInt32(&shared) != 10 || atomic.LoadInt32(&ephemeral) != 10 {
+		t.Fatalf("shared: %d, ephemeral: %d", shared, ephemeral)
+	}
+}
+
+func TestHealthy(t *testing.T) {
+	c, err := NewClient("test.memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !c.Healthy() {
+		t.Fatal("client is not healthy")
+	}
+
+	c.Close()
+
+	if c.Healthy() {
+		t.Fatal("client is healthy after close")
+	}
+}
+
+func TestTopic(t *testing.T) {
+	c, err := NewClient("test.memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	type order struct {
+		ID    string `json:"id"`
+		Price int    `json:"price"`
+	}
+
+	var orders = broker.NewTopic[order]("orders", func(o *broker.TopicOptions) {
+		o.Client = c
+	})
+	var names = broker.NewTopic[*wrapperspb.StringValue]("names", func(o *broker.TopicOptions) {
+		o.Client = c
+	})
+
+	var received = make(chan interface{}, 2)
+	orders.Subscribe(func(ctx context.Context, v order, event broker.Event) error {
+		received <- v
+		return nil
+	})
+	names.Subscribe(func(ctx context.Context, v *wrapperspb.StringValue, event broker.Event) error {
+		received <- v.GetValue()
+		return nil
+	})
+
+	if err := orders.Publish(context.Background(), order{ID: "1", Price: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if err := names.Publish(context.Background(), wrapperspb.String("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case v := <-received:
+			switch v := v.(type) {
+			case order:
+				if v.ID != "1" || v.Price != 100 {
+					t.Fatalf("unexpected order: %+v", v)
+				}
+			case string:
+				if v != "hello" {
+					t.Fatalf("unexpected name: %s", v)
+				}
+			}
+		case <-time.After(time.Second):
+			t.Fatal("message not received")
+		}
+	}
+}
+
+func TestPublishBatch(t *testing.T) {
+	c, err := NewClient("test.memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var topic = "batch"
+
+	var received = make(chan struct{}, 3)
+	c.Subscribe(topic, func(ctx context.Context, event broker.Event) error {
+		received <- struct{}{}
+		return nil
+	})
+
+	results, err := c.PublishBatch(topic, []interface{}{"a", "b", "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("unexpected results: %d", len(results))
+	}
+	for _, result := range results {
+		if result.Err != nil || result.Receipt.Topic != topic {
+			t.Fatalf("unexpected result: %+v", result)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-received:
+		case <-time.NewTimer(time.Second).C:
+			t.Fatal("consume timeout")
+		}
+	}
+}
+
+func TestContentType(t *testing.T) {
+	c, err := NewClient("test.memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// 订阅方使用默认的 json codec, 按消息头中的 content-type 解码
+	for _, m := range []codec.Marshaler{proto.Marshaler, protojson.Marshaler} {
+		var topic = "content.type." + strings.TrimPrefix(m.ContentType().String(), "application/")
+
+		var received = make(chan string, 1)
+		c.Subscribe(topic, func(ctx context.Context, event broker.Event) error {
+			var v = new(wrapperspb.StringValue)
+			if err := event.Unmarshal(v); err != nil {
+				return err
+			}
+			received <- v.GetValue()
+			return nil
+		})
+
+		if err := c.Publish(topic, wrapperspb.String("hello"), func(o *broker.PublishOptions) {
+			o.Codec = m
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case v := <-received:
+			if v != "hello" {
+				t.Fatalf("%s: unexpected value: %s", m.ContentType(), v)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: message not received", m.ContentType())
+		}
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	c, err := NewClient("test.memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	type order struct {
+		ID    string `json:"id"`
+		Price int    `json:"price"`
+	}
+
+	for _, m := range []codec.Marshaler{msgpack.Marshaler, cbor.Marshaler} {
+		var topic = "codecs." + strings.TrimPrefix(m.ContentType().String(), "application/")
+
+		var received = make(chan *order, 1)
+		c.Subscribe(topic, func(ctx context.Context, event broker.Event) error {
+			var v = new(order)
+			if err := event.Unmarshal(v); err != nil {
+				return err
+			}
+			if event.ID() == "" {
+				return errors.New("message id is empty")
+			}
+			received <- v
+			return nil
+		})
+
+		if err := c.Publish(topic, &order{ID: "1", Price: 100}, func(o *broker.PublishOptions) {
+			o.Codec = m
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case v := <-received:
+			if v.ID != "1" || v.Price != 100 {
+				t.Fatalf("%s: unexpected order: %+v", m.ContentType(), v)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: message not received", m.ContentType())
+		}
+	}
+}
+
+func TestWrappedCodec(t *testing.T) {
+	c, err := NewClient("test.memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var keys = func(o *encrypt.Options) {
+		o.Keys = map[string][]byte{"test": []byte("0123456789abcdef0123456789abcdef")}
+		o.KeyID = "test"
+	}
+	// 订阅方注册密钥后, 按消息头解密
+	if err := encrypt.Register(keys); err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := encrypt.NewMarshaler(compress.NewMarshaler(json.Marshaler), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var topic = "wrapped"
+
+	// 订阅方使用默认的 codec
+	var received = make(chan string, 1)
+	c.Subscribe(topic, func(ctx context.Context, event broker.Event) error {
+		var v string
+		if err := event.Unmarshal(&v); err != nil {
+			return err
+		}
+		received <- v
+		return nil
+	})
+
+	for _, m := range []codec.Marshaler{
+		compress.NewMarshaler(json.Marshaler, func(o *compress.Options) {
+			o.Algorithm = compress.Zstd
+		}),
+		encrypted,
+	} {
+		if err := c.Publish(topic, "hello", func(o *broker.PublishOptions) {
+			o.Codec = m
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case v := <-received:
+			if v != "hello" {
+				t.Fatalf("%s: unexpected value: %s", codec.ContentEncoding(m), v)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: message not received", codec.ContentEncoding(m))
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package broker
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// published 发布成功的消息数
+	published = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "broker",
+			Name:      "published_total",
+			Help:      "Total number of messages published.",
+		}, []string{"topic"},
+	)
+	// publishFailed 发布失败的消息数
+	publishFailed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "broker",
+			Name:      "publish_failed_total",
+			Help:      "Total number of messages failed to publish.",
+		}, []string{"topic"},
+	)
+	// consumed 接收的消息数
+	consumed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "broker",
+			Name:      "consumed_total",
+			Help:      "Total number of messages consumed.",
+		}, []string{"topic"},
+	)
+	// handlerErrors handler 执行失败次数, 包括重试
+	handlerErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "broker",
+			Name:      "handler_errors_total",
+			Help:      "Total number of broker handler errors.",
+		}, []string{"topic"},
+	)
+	// handled handler 执行耗时
+	handled = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "broker",
+			Name:      "handler_duration_seconds",
+			Help:      "Duration of broker handlers in seconds.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"topic", "status"},
+	)
+	// lag kafka 分区的消费延迟
+	lag = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "broker",
+			Name:      "kafka_consumer_lag",
+			Help:      "Number of messages behind the high watermark of the kafka partition.",
+		}, []string{"topic", "group", "partition"},
+	)
+	// pending nats consumer 待投递的消息数
+	pending = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "broker",
+			Name:      "nats_consumer_pending",
+			Help:      "Number of messages pending delivery to the JetStream consumer.",
+		}, []string{"topic", "consumer"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(published, publishFailed, consumed, handlerErrors, handled, lag, pending)
+}
+
+// ObservePublish 记录消息发布结果。由 broker 实现在确认发布结果后调用
+func ObservePublish(topic string, err error) {
+	if err != nil {
+		publishFailed.WithLabelValues(topic).Inc()
+	} else {
+		published.WithLabelValues(topic).Inc()
+	}
+}
+
+// ObserveLag 记录 kafka 分区的消费延迟
+func ObserveLag(topic string, group string, partition int32, n int64) {
+	if n < 0 {
+		n = 0
+	}
+	lag.WithLabelValues(topic, group, strconv.Itoa(int(partition))).Set(float64(n))
+}
+
+// ObservePending 记录 nats consumer 待投递的消息数
+func ObservePending(topic string, consumer string, n uint64) {
+	pending.WithLabelValues(topic, consumer).Set(float64(n))
+}
+
+// instrument 记录 handler 执行次数、耗时及结果
+func instrument() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, event Event) error {
+			start := time.Now()
+
+			err := next(ctx, event)
+
+			var status = "success"
+			if err != nil {
+				status = "failure"
+				handlerErrors.WithLabelValues(event.Topic()).Inc()
+			}
+			handled.WithLabelValues(event.Topic(), status).Observe(time.Since(start).Seconds())
+			return err
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package broker
+
+import (
+	"context"
+	"runtime"
+
+	"github.com/pkg/errors"
+)
+
+// Middleware handler 中间件
+type Middleware func(next Handler) Handler
+
+// Chain 组合中间件。第一个中间件位于最外层
+func Chain(h Handler, mws ...Middleware) Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		if mws[i] != nil {
+			h = mws[i](h)
+		}
+	}
+	return h
+}
+
+// Recovery 将 handler 中的 panic 转换为 error, 避免消费者进程退出
+func Recovery() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, event Event) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					stack := make([]byte, 1<<13)
+					stack = stack[:runtime.Stack(stack, false)]
+
+					err = errors.Errorf("panic: %v\nStack: [%s]", r, stack)
+				}
+			}()
+
+			return next(ctx, event)
+		}
+	}
+}
+
+// WrapHandler 为 handler 添加中间件。执行顺序: 指标 -> Recovery -> Options.Middlewares -> SubscribeOptions.Middlewares -> handler
+func WrapHandler(h Handler, o *Options, so *SubscribeOptions) Handler {
+	var mws = make([]Middleware, 0, 2+len(o.Middlewares)+len(so.Middlewares))
+	mws = append(mws, instrument(), Recovery())
+	mws = append(mws, o.Middlewares...)
+	mws = append(mws, so.Middlewares...)
+	return Chain(h, mws...)
+}
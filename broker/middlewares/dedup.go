@@ -0,0 +1,203 @@
+package middlewares
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charlesbases/logger"
+
+	"github.com/pkg/errors"
+
+	"github.com/charlesbases/library/broker"
+	"github.com/charlesbases/library/redis"
+)
+
+// dedupPrefixKey redis 消息去重的 key 前缀
+var dedupPrefixKey = redis.KeyPrefix("dedup_")
+
+// defaultDedupLease 消息处理中标记的有效期, 与 nats 默认的 AckWait 一致。
+// 进程在处理期间退出时, 标记过期后重新投递的消息可再次处理
+const defaultDedupLease = 30 * time.Second
+
+const (
+	// dedupProcessing 消息处理中
+	dedupProcessing = "processing"
+	// dedupDone 消息已处理
+	dedupDone = "done"
+)
+
+// ErrProcessing 相同标识的消息正在处理, 消息重新投递
+var ErrProcessing = errors.Wrap(broker.ErrRedeliver, "duplicate message is processing")
+
+// marker 消息处理标记
+type marker interface {
+	// reserve 标记消息为处理中。消息已处理时返回 false; 消息正在处理时返回 ErrProcessing
+	reserve(ctx context.Context, event broker.Event, key string) (bool, error)
+	// complete 标记消息为已处理, 在 ttl 内跳过相同标识的消息
+	complete(ctx context.Context, event broker.Event, key string)
+	// release 释放标记
+	release(ctx context.Context, event broker.Event, key string)
+}
+
+// mark 进程内的消息标记
+type mark struct {
+	done   bool
+	expiry time.Time
+}
+
+// dedup .
+type dedup struct {
+	ttl time.Duration
+
+	// seen 消息标识 -> 标记
+	seen  map[string]mark
+	sweep time.Time
+	lock  sync.Mutex
+}
+
+// reserve .
+func (d *dedup) reserve(_ context.Context, _ broker.Event, key string) (bool, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	var now = time.Now()
+
+	// 清理过期标记
+	if now.After(d.sweep) {
+		for k, m := range d.seen {
+			if now.After(m.expiry) {
+				delete(d.seen, k)
+			}
+		}
+		d.sweep = now.Add(d.ttl)
+	}
+
+	if m, found := d.seen[key]; found && now.Before(m.expiry) {
+		if m.done {
+			return false, nil
+		}
+		return false, ErrProcessing
+	}
+	d.seen[key] = mark{expiry: now.Add(defaultDedupLease)}
+	return true, nil
+}
+
+// complete .
+func (d *dedup) complete(_ context.Context, _ broker.Event, key string) {
+	d.lock.Lock()
+	d.seen[key] = mark{done: true, expiry: time.Now().Add(d.ttl)}
+	d.lock.Unlock()
+}
+
+// release .
+func (d *dedup) release(_ context.Context, _ broker.Event, key string) {
+	d.lock.Lock()
+	delete(d.seen, key)
+	d.lock.Unlock()
+}
+
+// redisDedup .
+type redisDedup struct {
+	group string
+	ttl   time.Duration
+}
+
+// rkey redis key: dedup_{group}.{topic}.{key}
+func (d *redisDedup) rkey(event broker.Event, key string) string {
+	return strings.Join([]string{d.group, event.Topic(), key}, ".")
+}
+
+// reserve 写入处理中标记, 有效期为 defaultDedupLease。标记已存在时, 根据标记判断消息是否已处理
+func (d *redisDedup) reserve(ctx context.Context, event broker.Event, key string) (bool, error) {
+	var rkey = dedupPrefixKey(d.rkey(event, key))
+
+	output := redis.Client().SetNX(rkey, dedupProcessing, func(o *redis.SetOptions) {
+		o.Context = ctx
+		o.TTL = defaultDedupLease
+	})
+	if output.Err() != nil || output.Val() {
+		return output.Val(), output.Err()
+	}
+
+	// 标记在此期间过期时返回错误, 消息按 SubscribeOptions 重试
+	var state string
+	if err := redis.Client().Get(rkey, func(o *redis.GetOptions) {
+		o.Context = ctx
+	}).Unmarshal(&state); err != nil {
+		return false, err
+	}
+
+	if state == dedupDone {
+		return false, nil
+	}
+	return false, ErrProcessing
+}
+
+// complete 以已处理标记覆盖处理中标记, 有效期为 ttl
+func (d *redisDedup) complete(ctx context.Context, event broker.Event, key string) {
+	if err := redis.Client().Set(dedupPrefixKey(d.rkey(event, key)), dedupDone, func(o *redis.SetOptions) {
+		o.Context = ctx
+		o.TTL = d.ttl
+	}).Err(); err != nil {
+		logger.Context(ctx).Errorf(`[broker]: handle["%s"]: complete "%s": %v`, event.Topic(), key, err)
+	}
+}
+
+// release .
+func (d *redisDedup) release(ctx context.Context, event broker.Event, key string) {
+	if err := redis.Client().Del(dedupPrefixKey(d.rkey(event, key)), func(o *redis.DelOptions) {
+		o.Context = ctx
+	}).Err(); err != nil {
+		logger.Context(ctx).Errorf(`[broker]: handle["%s"]: release "%s": %v`, event.Topic(), key, err)
+	}
+}
+
+// deduplicate .
+func deduplicate(m marker, key func(event broker.Event) string) broker.Middleware {
+	if key == nil {
+		key = broker.Event.ID
+	}
+
+	return func(next broker.Handler) broker.Handler {
+		return func(ctx context.Context, event broker.Event) error {
+			var id = key(event)
+			if len(id) == 0 {
+				return next(ctx, event)
+			}
+
+			ok, err := m.reserve(ctx, event, id)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				logger.Context(ctx).Debugf(`[broker]: handle["%s"]: duplicate message of "%s"`, event.Topic(), id)
+				return nil
+			}
+
+			if err = next(ctx, event); err != nil {
+				m.release(ctx, event, id)
+				return err
+			}
+
+			m.complete(ctx, event, id)
+			return nil
+		}
+	}
+}
+
+// Dedup 进程内消息去重, 在 ttl 内跳过已处理的消息。handler 执行失败时释放标记, 以便重试;
+// 相同标识的消息正在处理时返回 ErrProcessing, 消息重新投递。
+// key 为消息唯一标识, 为 nil 时使用 Event.ID(); 标识为空的消息不去重
+func Dedup(ttl time.Duration, key func(event broker.Event) string) broker.Middleware {
+	return deduplicate(&dedup{ttl: ttl, seen: make(map[string]mark)}, key)
+}
+
+// RedisDedup 基于 redis 的消息去重, 多副本间共享已处理的消息标识, 需先初始化 redis.Init()。
+// group 为去重范围, 共同消费同一 topic 的副本应使用相同的 group, 通常为服务名;
+// key 同 Dedup。处理中标记的有效期为 defaultDedupLease, handler 执行成功后标记为已处理, 有效期为 ttl;
+// redis 不可用时 handler 返回错误, 消息按 SubscribeOptions 重试
+func RedisDedup(group string, ttl time.Duration, key func(event broker.Event) string) broker.Middleware {
+	return deduplicate(&redisDedup{group: group, ttl: ttl}, key)
+}
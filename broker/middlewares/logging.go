@@ -0,0 +1,27 @@
+package middlewares
+
+import (
+	"context"
+	"time"
+
+	"github.com/charlesbases/logger"
+
+	"github.com/charlesbases/library/broker"
+)
+
+// Logging 记录 handler 执行结果及耗时
+func Logging() broker.Middleware {
+	return func(next broker.Handler) broker.Handler {
+		return func(ctx context.Context, event broker.Event) error {
+			start := time.Now()
+
+			err := next(ctx, event)
+			if err != nil {
+				logger.Context(ctx).Errorf(`[broker]: handle["%s"]: %v | %v`, event.Topic(), time.Since(start), err)
+			} else {
+				logger.Context(ctx).Debugf(`[broker]: handle["%s"]: %v`, event.Topic(), time.Since(start))
+			}
+			return err
+		}
+	}
+}
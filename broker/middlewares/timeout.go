@@ -0,0 +1,20 @@
+package middlewares
+
+import (
+	"context"
+	"time"
+
+	"github.com/charlesbases/library/broker"
+)
+
+// Timeout 为 handler 的 ctx 设置超时时间。handler 需要监听 ctx.Done()
+func Timeout(d time.Duration) broker.Middleware {
+	return func(next broker.Handler) broker.Handler {
+		return func(ctx context.Context, event broker.Event) error {
+			ctx, cancel := context.WithTimeout(ctx, d)
+			defer cancel()
+
+			return next(ctx, event)
+		}
+	}
+}
@@ -1,25 +1,24 @@
 package nats
 
 import (
-	"crypto/tls"
+	"context"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/charlesbases/logger"
 
-	"github.com/google/uuid"
-
 	"github.com/nats-io/nats.go"
 
 	"github.com/pkg/errors"
 
-	"github.com/charlesbases/library"
-
 	"github.com/charlesbases/library/broker"
-
-	"github.com/charlesbases/library/content"
 )
 
+// defaultDrainInterval 等待 drain 完成的检查间隔
+const defaultDrainInterval = 50 * time.Millisecond
+
 // client .
 type client struct {
 	id   string
@@ -28,19 +27,66 @@ type client struct {
 	conn *nats.Conn
 	js   nats.JetStreamContext
 
-	actived bool
+	// stream stream 配置模板
+	stream *nats.StreamConfig
+	// streams 已检查的 stream
+	streams sync.Map
+
+	actived atomic.Bool
+}
+
+// options 连接配置。未配置 TLS 时, 由服务端决定是否使用 tls, 并校验服务端证书
+func (c *client) options() ([]nats.Option, error) {
+	var opts = []nats.Option{
+		nats.Name(c.id),
+		// 断开后持续重连, 重连后 nats 自动恢复订阅
+		nats.MaxReconnects(-1),
+		nats.CustomReconnectDelay(func(attempts int) time.Duration {
+			return c.opts.ReconnectBackoff(attempts + 1)
+		}),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if c.actived.Load() {
+				logger.Errorf(`[nats]: disconnected: %v`, err)
+				c.opts.NotifyDisconnected(err)
+			}
+		}),
+		nats.ReconnectHandler(func(conn *nats.Conn) {
+			logger.Debugf(`[nats]: reconnected to %s`, conn.ConnectedUrlRedacted())
+			c.opts.NotifyReconnected()
+		}),
+	}
+
+	switch {
+	case len(c.opts.Credentials) != 0:
+		opts = append(opts, nats.UserCredentials(c.opts.Credentials))
+	case len(c.opts.NKeySeed) != 0:
+		opt, err := nats.NkeyOptionFromSeed(c.opts.NKeySeed)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, opt)
+	case len(c.opts.Username) != 0:
+		opts = append(opts, nats.UserInfo(c.opts.Username, c.opts.Password))
+	}
+
+	if c.opts.TLS != nil {
+		conf, err := c.opts.TLS.Config()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, nats.Secure(conf))
+	}
+	return opts, nil
 }
 
 // connect .
 func (c *client) connect() error {
-	conn, err := nats.Connect(
-		c.opts.Address, func(o *nats.Options) error {
-			o.Name = c.id
-			o.ReconnectWait = c.opts.ReconnectWait
-			o.TLSConfig = &tls.Config{InsecureSkipVerify: true}
-			return nil
-		},
-	)
+	opts, err := c.options()
+	if err != nil {
+		return err
+	}
+
+	conn, err := nats.Connect(strings.Join(c.opts.Addresses(), ","), opts...)
 	if err != nil {
 		return err
 	}
@@ -52,80 +98,98 @@ func (c *client) connect() error {
 
 	c.conn = conn
 	c.js = js
+
+	c.actived.Store(true)
+	c.opts.NotifyConnected()
 	return nil
 }
 
-// orCreateStream add js if js name not existed
-func (c *client) orCreateStream(v string) error {
-	var err error
-	if _, err = c.js.StreamInfo(v); err == nats.ErrStreamNotFound {
-		_, err = c.js.AddStream(
-			&nats.StreamConfig{
-				Name:      v,
-				Subjects:  []string{v},
-				MaxAge:    7 * 24 * time.Hour,
-				Retention: nats.WorkQueuePolicy,
-			},
-		)
+// natsHeader broker.Header to nats.Header
+func natsHeader(h broker.Header) nats.Header {
+	var out = make(nats.Header, len(h))
+	for key, val := range h {
+		out.Set(key, val)
 	}
-	return err
+	return out
 }
 
-// publish .
-func (c *client) publish(subject string, v interface{}, opts ...func(o *broker.PublishOptions)) error {
-	if !c.actived {
-		return broker.ErrNotReady
+// brokerHeader nats.Header to broker.Header
+func brokerHeader(h nats.Header) broker.Header {
+	var out = make(broker.Header, len(h))
+	for key := range h {
+		out.Set(key, h.Get(key))
+	}
+	return out
+}
+
+// prepare 检查发布条件, 返回 subject 所在的 stream
+func (c *client) prepare(subject string, o *broker.PublishOptions) (string, error) {
+	if !c.actived.Load() {
+		return "", broker.ErrNotReady
+	}
+
+	if o.Delayed() {
+		return "", broker.ErrDelayNotSupported
 	}
 
 	if err := broker.CheckSubject(subject); err != nil {
-		return err
+		return "", err
 	}
 
-	var o = broker.ParsePublishOptions(opts...)
+	if err := c.orCreateStream(subject); err != nil {
+		return "", err
+	}
+	return c.streamOf(subject).Name, nil
+}
 
-	err := c.orCreateStream(subject)
+// encode .
+func (c *client) encode(subject string, v interface{}, header nats.Header, o *broker.PublishOptions) (*nats.Msg, error) {
+	data, err := broker.Marshal(c.id, v, o.Codec)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	var data []byte
-	switch o.Codec.ContentType() {
-	case content.Json:
-		data, err = o.Codec.Marshal(
-			&broker.JsonMessage{
-				ID:        uuid.NewString(),
-				Producer:  c.id,
-				CreatedAt: library.NowString(),
-				Data:      v,
-			},
-		)
-	case content.Proto:
-		data, err = o.Codec.Marshal(v)
-	default:
-		err = errors.Errorf("unsupported content-type of %v.", o.Codec.ContentType().String())
+	return &nats.Msg{
+		Subject: subject,
+		Header:  header,
+		Data:    data,
+	}, nil
+}
+
+// message .
+func (c *client) message(subject string, v interface{}, o *broker.PublishOptions) (*nats.Msg, string, error) {
+	stream, err := c.prepare(subject, o)
+	if err != nil {
+		return nil, "", err
 	}
 
+	msg, err := c.encode(subject, v, natsHeader(broker.Inject(o.Context, o.Header)), o)
+	return msg, stream, err
+}
+
+// publish .
+func (c *client) publish(subject string, v interface{}, o *broker.PublishOptions) error {
+	msg, stream, err := c.message(subject, v, o)
 	if err != nil {
+		broker.ObservePublish(subject, err)
 		return err
 	}
 
 	// publish
-	if ack, err := c.js.PublishMsgAsync(
-		&nats.Msg{
-			Subject: subject,
-			Reply:   subject,
-			Data:    data,
-		}, nats.ExpectStream(subject),
-	); err != nil {
+	if ack, err := c.js.PublishMsgAsync(msg, nats.ExpectStream(stream)); err != nil {
+		broker.ObservePublish(subject, err)
 		return err
 	} else {
 		go func() {
 			select {
 			case <-ack.Ok():
-				logger.Context(o.Context).Debugf(`[nats]: publish["%s"]: %s`, subject, o.Codec.RawMessage(data))
+				broker.ObservePublish(subject, nil)
+				logger.Context(o.Context).Debugf(`[nats]: publish["%s"]: %s`, subject, o.Codec.RawMessage(msg.Data))
 			case err := <-ack.Err():
+				broker.ObservePublish(subject, err)
 				logger.Context(o.Context).Errorf(`[nats]: publish["%s"]: %v`, subject, err)
 			case <-time.NewTimer(o.Timeout).C:
+				broker.ObservePublish(subject, broker.ErrPublishTimeout)
 				logger.Context(o.Context).Errorf(`[nats]: publish["%s"]: publish timeout`, subject)
 			}
 		}()
@@ -135,47 +199,326 @@ func (c *client) publish(subject string, v interface{}, opts ...func(o *broker.P
 
 // Publish .
 func (c *client) Publish(subject string, v interface{}, opts ...func(o *broker.PublishOptions)) error {
-	return errors.Wrapf(c.publish(subject, v, opts...), `[nats]: publish["%s"]`, subject)
+	return errors.Wrapf(c.publish(subject, v, broker.ParsePublishOptions(opts...)), `[nats]: publish["%s"]`, subject)
+}
+
+// publishSync .
+func (c *client) publishSync(subject string, v interface{}, o *broker.PublishOptions) (*broker.Receipt, error) {
+	msg, stream, err := c.message(subject, v, o)
+	if err != nil {
+		return nil, err
+	}
+
+	ack, err := c.js.PublishMsg(msg, nats.ExpectStream(stream), nats.AckWait(o.Timeout))
+	if err != nil {
+		if err == nats.ErrTimeout {
+			return nil, broker.ErrPublishTimeout
+		}
+		return nil, err
+	}
+
+	logger.CallerSkip(o.CallerSkip+1).Context(o.Context).Debugf(`[nats]: publish["%s"]: stream: %s, sequence: %d: %s`, subject, ack.Stream, ack.Sequence, o.Codec.RawMessage(msg.Data))
+	return &broker.Receipt{Topic: subject, Stream: ack.Stream, Sequence: ack.Sequence}, nil
+}
+
+// PublishSync .
+func (c *client) PublishSync(subject string, v interface{}, opts ...func(o *broker.PublishOptions)) (*broker.Receipt, error) {
+	receipt, err := c.publishSync(subject, v, broker.ParsePublishOptions(opts...))
+	broker.ObservePublish(subject, err)
+	return receipt, errors.Wrapf(err, `[nats]: publish["%s"]`, subject)
+}
+
+// publishBatch 异步发布全部消息后统一等待确认
+func (c *client) publishBatch(subject string, vs []interface{}, o *broker.PublishOptions) ([]broker.Result, error) {
+	stream, err := c.prepare(subject, o)
+	if err != nil {
+		return nil, err
+	}
+
+	var header = natsHeader(broker.Inject(o.Context, o.Header))
+	var results = make([]broker.Result, len(vs))
+	var futures = make([]nats.PubAckFuture, len(vs))
+
+	for i, v := range vs {
+		msg, err := c.encode(subject, v, header, o)
+		if err == nil {
+			futures[i], err = c.js.PublishMsgAsync(msg, nats.ExpectStream(stream))
+		}
+		if err != nil {
+			results[i].Err = err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), o.Timeout)
+	defer cancel()
+
+	var failed int
+	for i, future := range futures {
+		if future != nil {
+			select {
+			case ack := <-future.Ok():
+				results[i].Receipt = &broker.Receipt{Topic: subject, Stream: ack.Stream, Sequence: ack.Sequence}
+			case err := <-future.Err():
+				results[i].Err = err
+			case <-ctx.Done():
+				results[i].Err = broker.ErrPublishTimeout
+			}
+		}
+
+		if results[i].Err != nil {
+			failed++
+		}
+		broker.ObservePublish(subject, results[i].Err)
+	}
+
+	logger.CallerSkip(o.CallerSkip+1).Context(o.Context).Debugf(`[nats]: publish["%s"]: batch: %d, failed: %d`, subject, len(vs), failed)
+	return results, nil
+}
+
+// PublishBatch .
+func (c *client) PublishBatch(subject string, vs []interface{}, opts ...func(o *broker.PublishOptions)) ([]broker.Result, error) {
+	results, err := c.publishBatch(subject, vs, broker.ParsePublishOptions(opts...))
+	return results, errors.Wrapf(err, `[nats]: publish["%s"]`, subject)
+}
+
+// request 通过 inbox 接收应答
+func (c *client) request(subject string, v interface{}, timeout time.Duration, opts ...func(o *broker.PublishOptions)) (broker.Event, error) {
+	if !c.actived.Load() {
+		return nil, broker.ErrNotReady
+	}
+
+	var inbox = nats.NewInbox()
+	sub, err := c.conn.SubscribeSync(inbox)
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+
+	var o = broker.ParsePublishOptions(opts...)
+	o.Header = o.Header.Clone()
+	o.Header.Set(broker.HeaderReplyTo, inbox)
+
+	if err := c.publish(subject, v, o); err != nil {
+		return nil, err
+	}
+
+	msg, err := sub.NextMsg(timeout)
+	if err != nil {
+		if err == nats.ErrTimeout {
+			return nil, broker.ErrRequestTimeout
+		}
+		return nil, err
+	}
+
+	event := broker.NewEvent(subject, "", msg.Data, o.Codec, func(eo *broker.EventOptions) {
+		eo.Context = o.Context
+		eo.Header = brokerHeader(msg.Header)
+	})
+
+	logger.Context(o.Context).Debugf(`[nats]: request["%s"]: reply: %s`, subject, event.Codec().RawMessage(msg.Data))
+	return event, nil
+}
+
+// Request .
+func (c *client) Request(subject string, v interface{}, timeout time.Duration, opts ...func(o *broker.PublishOptions)) (broker.Event, error) {
+	event, err := c.request(subject, v, timeout, opts...)
+	return event, errors.Wrapf(err, `[nats]: request["%s"]`, subject)
+}
+
+// responder 应答至请求方的 inbox
+func (c *client) responder(reply string) func(o *broker.EventOptions) {
+	return func(o *broker.EventOptions) {
+		o.Responder = func(v interface{}, opts ...func(o *broker.PublishOptions)) error {
+			var po = broker.ParsePublishOptions(opts...)
+
+			data, err := broker.Marshal(c.id, v, po.Codec)
+			if err != nil {
+				return errors.Wrapf(err, `[nats]: respond["%s"]`, reply)
+			}
+
+			logger.Context(po.Context).Debugf(`[nats]: respond["%s"]: %s`, reply, po.Codec.RawMessage(data))
+			return errors.Wrapf(
+				c.conn.PublishMsg(
+					&nats.Msg{
+						Subject: reply,
+						Header:  natsHeader(broker.Inject(po.Context, po.Header)),
+						Data:    data,
+					},
+				), `[nats]: respond["%s"]`, reply,
+			)
+		}
+	}
+}
+
+// subscription .
+type subscription struct {
+	topic string
+	sub   *nats.Subscription
+
+	cancel     context.CancelFunc
+	dispatcher *broker.Dispatcher
+}
+
+// Topic .
+func (s *subscription) Topic() string {
+	return s.topic
+}
+
+// Unsubscribe .
+func (s *subscription) Unsubscribe() error {
+	defer s.cancel()
+
+	logger.Debugf(`[nats]: unsubscribe["%s"]`, s.topic)
+	return errors.Wrapf(s.sub.Unsubscribe(), `[nats]: unsubscribe["%s"]`, s.topic)
+}
+
+// Drain .
+func (s *subscription) Drain() error {
+	defer s.cancel()
+
+	logger.Debugf(`[nats]: drain["%s"]`, s.topic)
+	if err := s.sub.Drain(); err != nil {
+		return errors.Wrapf(err, `[nats]: drain["%s"]`, s.topic)
+	}
+
+	// nats.Subscription.Drain 为异步执行, 等待已接收的消息处理完成
+	t := time.NewTicker(defaultDrainInterval)
+	defer t.Stop()
+
+	for s.sub.IsValid() {
+		<-t.C
+	}
+
+	s.dispatcher.Wait()
+	return nil
 }
 
 // subscribe .
-func (c *client) subscribe(subject string, handler broker.Handler, opts ...func(o *broker.SubscribeOptions)) error {
-	if !c.actived {
-		return broker.ErrNotReady
+func (c *client) subscribe(subject string, handler broker.Handler, opts ...func(o *broker.SubscribeOptions)) (broker.Subscription, error) {
+	if !c.actived.Load() {
+		return nil, broker.ErrNotReady
 	}
 
 	if err := broker.CheckSubject(subject); err != nil {
-		return err
+		return nil, err
 	}
 
 	logger.Debugf(`[nats]: subscribe["%s"]`, subject)
 
+	if err := c.orCreateStream(subject); err != nil {
+		return nil, err
+	}
+
 	var o = broker.ParseSubscribeOptions(opts...)
-	_, err := c.js.QueueSubscribe(
-		subject, o.ConsumerModel(c.id, subject),
-		func(msg *nats.Msg) {
-			msg.Ack()
-
-			logger.Debugf(`[nats]: consume["%s"]: %s`, msg.Subject, o.Codec.RawMessage(msg.Data))
-			if err := handler(broker.NewEvent(msg.Subject, msg.Reply, msg.Data, o.Codec)); err != nil {
-				logger.Errorf(`[nats]: consume["%s"]: %v`, msg.Subject, err)
+	handler = broker.WrapHandler(handler, c.opts, o)
+
+	ctx, cancel := context.WithCancel(o.Context)
+	o.Context = ctx
+
+	var dispatcher = broker.NewDispatcher(o)
+
+	// 未确认的消息数不超过 Concurrency, 避免消息积压在客户端。
+	// nats 没有分区, 顺序消费时 consumer 同时只投递一条未确认的消息
+	var maxAckPending = o.Concurrency
+	if o.Ordered {
+		maxAckPending = 1
+	}
+
+	var subOpts = []nats.SubOpt{
+		nats.ManualAck(),
+		nats.MaxAckPending(maxAckPending),
+	}
+
+	switch o.Start {
+	case broker.StartEarliest:
+		subOpts = append(subOpts, nats.DeliverAll())
+	case broker.StartLatest:
+		subOpts = append(subOpts, nats.DeliverNew())
+	case broker.StartAtTime:
+		subOpts = append(subOpts, nats.StartTime(o.StartTime))
+	case broker.StartAtSequence:
+		subOpts = append(subOpts, nats.StartSequence(uint64(o.StartSequence)))
+	}
+
+	var cb = func(msg *nats.Msg) {
+		var header = brokerHeader(msg.Header)
+		var reply = header.Get(broker.HeaderReplyTo)
+
+		var event = broker.NewEvent(
+			msg.Subject, reply, msg.Data, o.Codec, func(eo *broker.EventOptions) {
+				eo.Context = o.Context
+				eo.Header = header
+			}, c.responder(reply),
+		)
+
+		logger.Context(event.Context()).Debugf(`[nats]: consume["%s"]: %s`, msg.Subject, event.Codec().RawMessage(msg.Data))
+
+		if meta, err := msg.Metadata(); err == nil {
+			broker.ObservePending(msg.Subject, meta.Consumer, meta.NumPending)
+		}
+
+		// 达到并发上限时阻塞; 订阅已取消时消息重新投递
+		if !dispatcher.Dispatch(event.Key(), func() {
+			ack, err := broker.Retry(
+				c, event,
+				func(ctx context.Context, event broker.Event) error {
+					// 重置 AckWait, 避免重试期间消息被重新投递
+					msg.InProgress()
+					return handler(ctx, event)
+				}, o,
+			)
+			if err != nil {
+				logger.Context(event.Context()).Errorf(`[nats]: consume["%s"]: %v`, msg.Subject, err)
+			}
+
+			// handler 执行成功或进入死信后确认消息, 否则重新投递
+			if ack {
+				msg.Ack()
+			} else {
+				msg.Nak()
 			}
-		},
-		nats.Durable(strings.Join([]string{c.id, subject}, ".")),
-	)
-	return err
+		}) {
+			msg.Nak()
+		}
+	}
+
+	var sub *nats.Subscription
+	var err error
+
+	// 临时消费者使用 ephemeral consumer, 取消订阅后由 nats 删除
+	if o.Ephemeral {
+		sub, err = c.js.Subscribe(subject, cb, subOpts...)
+	} else {
+		var durable = consumerName(c.id, subject)
+		if err = c.updateConsumer(c.streamOf(subject).Name, subject, maxAckPending); err == nil {
+			sub, err = c.js.QueueSubscribe(
+				subject, o.ConsumerModel(c.id, subject), cb,
+				append(subOpts, nats.Durable(durable))...,
+			)
+		}
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return &subscription{topic: subject, sub: sub, cancel: cancel, dispatcher: dispatcher}, nil
 }
 
 // Subscribe .
-func (c *client) Subscribe(subject string, handler broker.Handler, opts ...func(o *broker.SubscribeOptions)) error {
-	return errors.Wrapf(c.subscribe(subject, handler, opts...), `[nats]: subscribe["%s"]`, subject)
+func (c *client) Subscribe(subject string, handler broker.Handler, opts ...func(o *broker.SubscribeOptions)) (broker.Subscription, error) {
+	sub, err := c.subscribe(subject, handler, opts...)
+	return sub, errors.Wrapf(err, `[nats]: subscribe["%s"]`, subject)
+}
+
+// Healthy .
+func (c *client) Healthy() bool {
+	return c.actived.Load() && c.conn.IsConnected()
 }
 
 // Close .
 func (c *client) Close() {
-	if c.actived {
-		c.actived = false
-
+	if c.actived.CompareAndSwap(true, false) {
 		c.conn.Flush()
 		c.conn.Close()
 	}
@@ -184,8 +527,15 @@ func (c *client) Close() {
 // NewClient .
 func NewClient(id string, opts ...func(o *broker.Options)) (broker.Client, error) {
 	c := &client{id: id, opts: broker.ParseOptions(opts...)}
-	if len(c.opts.Address) == 0 {
+	if len(c.opts.Addresses()) == 0 {
 		return nil, broker.ErrInvalidAddrs
 	}
+
+	stream, err := streamConfig(c.opts.Stream)
+	if err != nil {
+		return nil, err
+	}
+	c.stream = stream
+
 	return c, c.connect()
 }
@@ -0,0 +1,203 @@
+package nats
+
+import (
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/charlesbases/logger"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/pkg/errors"
+
+	"github.com/charlesbases/library/broker"
+)
+
+// defaultStreamMaxAge stream 默认的消息保留时间
+const defaultStreamMaxAge = 7 * 24 * time.Hour
+
+// invalidName stream 与 consumer 名称中不允许出现的字符
+var invalidName = strings.NewReplacer(".", "_", "*", "_", ">", "_", " ", "_")
+
+// streamName topic 独立使用的 stream 名称
+func streamName(subject string) string {
+	return invalidName.Replace(subject)
+}
+
+// consumerName durable consumer 名称
+func consumerName(id string, subject string) string {
+	return invalidName.Replace(strings.Join([]string{id, subject}, "_"))
+}
+
+// legacyConsumerName 旧版本的 durable consumer 名称 "<id>.<subject>"。
+// 包含 '.' 的名称会被 nats.go 与 nats-server 拒绝, 无法继续使用或通过 api 删除
+func legacyConsumerName(id string, subject string) string {
+	return strings.Join([]string{id, subject}, ".")
+}
+
+// streamConfig 解析 broker.StreamOptions, 生成 stream 配置模板
+func streamConfig(o *broker.StreamOptions) (*nats.StreamConfig, error) {
+	conf := &nats.StreamConfig{
+		Retention: nats.WorkQueuePolicy,
+		MaxAge:    defaultStreamMaxAge,
+		MaxBytes:  -1,
+		MaxMsgs:   -1,
+		Storage:   nats.FileStorage,
+		Replicas:  1,
+	}
+	if o == nil {
+		return conf, nil
+	}
+
+	if len(o.Name) != 0 {
+		if len(o.Subjects) == 0 {
+			return nil, errors.Errorf(`[nats]: stream["%s"]: subjects cannot be empty`, o.Name)
+		}
+		conf.Name = o.Name
+		conf.Subjects = o.Subjects
+	}
+
+	switch strings.ToLower(o.Retention) {
+	case "", "workqueue":
+	case "limits":
+		conf.Retention = nats.LimitsPolicy
+	case "interest":
+		conf.Retention = nats.InterestPolicy
+	default:
+		return nil, errors.Errorf(`[nats]: invalid stream retention of "%s"`, o.Retention)
+	}
+
+	switch strings.ToLower(o.Storage) {
+	case "", "file":
+	case "memory":
+		conf.Storage = nats.MemoryStorage
+	default:
+		return nil, errors.Errorf(`[nats]: invalid stream storage of "%s"`, o.Storage)
+	}
+
+	switch {
+	case o.MaxAge < 0:
+		conf.MaxAge = 0
+	case o.MaxAge > 0:
+		conf.MaxAge = o.MaxAge
+	}
+	if o.MaxBytes > 0 {
+		conf.MaxBytes = o.MaxBytes
+	}
+	if o.MaxMsgs > 0 {
+		conf.MaxMsgs = o.MaxMsgs
+	}
+	if o.Replicas > 0 {
+		conf.Replicas = o.Replicas
+	}
+	return conf, nil
+}
+
+// subjectMatch subject 是否匹配 pattern。'*' 匹配一级, '>' 匹配之后的所有层级
+func subjectMatch(pattern string, subject string) bool {
+	var pts, sts = strings.Split(pattern, "."), strings.Split(subject, ".")
+	for i, pt := range pts {
+		switch {
+		case pt == ">":
+			return len(sts) > i
+		case i >= len(sts):
+			return false
+		case pt != "*" && pt != sts[i]:
+			return false
+		}
+	}
+	return len(pts) == len(sts)
+}
+
+// streamOf subject 所在 stream 的配置
+func (c *client) streamOf(subject string) *nats.StreamConfig {
+	conf := *c.stream
+
+	for _, pattern := range conf.Subjects {
+		if subjectMatch(pattern, subject) {
+			return &conf
+		}
+	}
+
+	conf.Name = streamName(subject)
+	conf.Subjects = []string{subject}
+	return &conf
+}
+
+// sameStream 已存在的 stream 是否与配置一致
+func sameStream(current *nats.StreamConfig, conf *nats.StreamConfig) bool {
+	return reflect.DeepEqual(current.Subjects, conf.Subjects) &&
+		current.Retention == conf.Retention &&
+		current.MaxAge == conf.MaxAge &&
+		current.MaxBytes == conf.MaxBytes &&
+		current.MaxMsgs == conf.MaxMsgs &&
+		current.Storage == conf.Storage &&
+		current.Replicas == conf.Replicas
+}
+
+// orCreateStream 创建 subject 所在的 stream。配置了 broker.Options.Stream 时, 更新与配置不一致的 stream。
+// 每个 stream 只检查一次
+func (c *client) orCreateStream(subject string) error {
+	var conf = c.streamOf(subject)
+	if _, found := c.streams.Load(conf.Name); found {
+		return nil
+	}
+
+	info, err := c.js.StreamInfo(conf.Name)
+	switch {
+	case errors.Is(err, nats.ErrStreamNotFound):
+		if _, err = c.js.AddStream(conf); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	case c.opts.Stream != nil && !sameStream(&info.Config, conf):
+		// retention 与 storage 不可修改, 更新失败时继续使用已存在的 stream
+		if _, err := c.js.UpdateStream(conf); err != nil {
+			logger.Errorf(`[nats]: update stream["%s"]: %v`, conf.Name, err)
+		} else {
+			logger.Debugf(`[nats]: stream["%s"] updated`, conf.Name)
+		}
+	}
+
+	c.streams.Store(conf.Name, struct{}{})
+	return nil
+}
+
+// updateConsumer 更新已存在的 durable consumer 的 MaxAckPending。
+// Concurrency 或 Ordered 调整后, 与已存在的 consumer 配置不一致会导致订阅失败
+func (c *client) updateConsumer(stream string, subject string, maxAckPending int) error {
+	var durable = consumerName(c.id, subject)
+
+	info, err := c.js.ConsumerInfo(stream, durable)
+	switch {
+	case errors.Is(err, nats.ErrConsumerNotFound):
+		c.legacyConsumer(stream, subject)
+		return nil
+	case err != nil:
+		return err
+	case info.Config.MaxAckPending == maxAckPending:
+		return nil
+	}
+
+	var conf = info.Config
+	conf.MaxAckPending = maxAckPending
+	if _, err := c.js.UpdateConsumer(stream, &conf); err != nil {
+		return err
+	}
+
+	logger.Debugf(`[nats]: consumer["%s"] updated`, durable)
+	return nil
+}
+
+// legacyConsumer 首次创建 durable consumer 时, 检查 stream 中是否残留旧版本名称的 consumer。
+// 旧的 consumer 不再接收新的订阅, 其未确认的消息需要手动处理后通过 `nats consumer rm` 删除
+func (c *client) legacyConsumer(stream string, subject string) {
+	var legacy = legacyConsumerName(c.id, subject)
+	for name := range c.js.ConsumerNames(stream) {
+		if name == legacy {
+			logger.Warnf(`[nats]: consumer["%s"] is deprecated, use consumer["%s"] and remove it manually`, legacy, consumerName(c.id, subject))
+		}
+	}
+}
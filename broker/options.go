@@ -2,51 +2,208 @@ package broker
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
 	"strings"
 	"time"
 
+	"github.com/google/uuid"
+
 	"github.com/charlesbases/library/codec"
 	"github.com/charlesbases/library/codec/json"
 )
 
 // Options .
 type Options struct {
-	// Address adress
+	// Address adress。多个地址以 ',' 分隔
 	Address string
-	// ReconnectWait 重连等待时间。单位：秒
+	// Addrs 地址列表, 与 Address 合并
+	Addrs []string
+	// Username 用户名。kafka: SASL 用户名; nats: user
+	Username string
+	// Password 密码。kafka: SASL 密码; nats: password
+	Password string
+	// SASLMechanism kafka SASL 认证方式: PLAIN, SCRAM-SHA-256, SCRAM-SHA-512。为空时不启用 SASL
+	SASLMechanism string
+	// Credentials nats 凭证文件(.creds)
+	Credentials string
+	// NKeySeed nats nkey seed 文件
+	NKeySeed string
+	// TLS tls 配置。为 nil 时不启用 tls
+	TLS *TLSOptions
+	// Stream nats JetStream stream 配置。为 nil 时每个 topic 使用独立的 stream, 保留策略为 workqueue, 保留 7 天
+	Stream *StreamOptions
+	// ReconnectWait 重连等待时间。default: 3s
 	ReconnectWait time.Duration
+	// MaxReconnectWait 最大重连等待时间。default: 1m
+	MaxReconnectWait time.Duration
+	// ReconnectBackoff 重连间隔。default: 从 ReconnectWait 开始指数增长, 不超过 MaxReconnectWait, 并加入随机抖动
+	ReconnectBackoff Backoff
+	// OnConnected 首次连接成功
+	OnConnected func()
+	// OnDisconnected 连接断开。主动关闭 client 时不调用
+	OnDisconnected func(err error)
+	// OnReconnected 重连成功。此时订阅已恢复或正在恢复
+	OnReconnected func()
 	// Version sarama.KafkaVersion
 	Version string
+	// ReplyTopic kafka 请求应答 topic。同一服务的副本应使用相同的 topic, 应答按 Correlation-ID 匹配。
+	// default: "<client id>.reply", client id 包含随机部分时, 每次启动都会创建新的 topic
+	ReplyTopic string
+	// Middlewares 作用于该 client 所有订阅的 handler 中间件
+	Middlewares []Middleware
 }
 
 // ParseOptions .
 func ParseOptions(opts ...func(o *Options)) *Options {
 	o := &Options{
-		ReconnectWait: defaultReconnectWait,
+		ReconnectWait:    defaultReconnectWait,
+		MaxReconnectWait: defaultMaxReconnectWait,
 	}
 
 	for _, opt := range opts {
 		opt(o)
 	}
+
+	// ReconnectWait 用作 time.Ticker 的间隔, 必须大于 0
+	if o.ReconnectWait <= 0 {
+		o.ReconnectWait = defaultReconnectWait
+	}
+	if o.MaxReconnectWait <= 0 {
+		o.MaxReconnectWait = defaultMaxReconnectWait
+	}
+
+	if o.ReconnectBackoff == nil {
+		o.ReconnectBackoff = Jitter(ExponentialBackoff(o.ReconnectWait, o.MaxReconnectWait))
+	}
 	return o
 }
 
+// NotifyConnected 调用 OnConnected
+func (o *Options) NotifyConnected() {
+	if o.OnConnected != nil {
+		o.OnConnected()
+	}
+}
+
+// NotifyDisconnected 调用 OnDisconnected
+func (o *Options) NotifyDisconnected(err error) {
+	if o.OnDisconnected != nil {
+		o.OnDisconnected(err)
+	}
+}
+
+// NotifyReconnected 调用 OnReconnected
+func (o *Options) NotifyReconnected() {
+	if o.OnReconnected != nil {
+		o.OnReconnected()
+	}
+}
+
+// Addresses 合并 Address 与 Addrs, 去除空地址
+func (o *Options) Addresses() []string {
+	var addrs = make([]string, 0, len(o.Addrs)+1)
+	for _, addr := range append(strings.Split(o.Address, ","), o.Addrs...) {
+		if addr = strings.TrimSpace(addr); len(addr) != 0 {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// TLSOptions .
+type TLSOptions struct {
+	// CAFile CA 证书。为空时使用系统根证书
+	CAFile string
+	// CertFile 客户端证书
+	CertFile string
+	// KeyFile 客户端私钥
+	KeyFile string
+	// InsecureSkipVerify 跳过服务端证书校验。仅用于测试环境
+	InsecureSkipVerify bool
+}
+
+// Config 生成 tls.Config
+func (o *TLSOptions) Config() (*tls.Config, error) {
+	conf := &tls.Config{InsecureSkipVerify: o.InsecureSkipVerify}
+
+	if len(o.CAFile) != 0 {
+		data, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, ErrInvalidCertificate
+		}
+		conf.RootCAs = pool
+	}
+
+	if len(o.CertFile) != 0 || len(o.KeyFile) != 0 {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+// StreamOptions nats JetStream stream 配置。
+// 配置变化时, 已存在的 stream 在首次发布或订阅时按配置更新, 其中 Retention 和 Storage 不可修改
+type StreamOptions struct {
+	// Name stream 名称。Subjects 包含的 topic 共用该 stream, 其余 topic 使用独立的 stream
+	Name string
+	// Subjects stream 包含的 subject, 支持通配符 '*' 与 '>', 如 "orders.>"
+	Subjects []string
+	// Retention 保留策略: limits, interest, workqueue。default: workqueue
+	Retention string
+	// MaxAge 消息保留时间。< 0 时不限制。default: 7d
+	MaxAge time.Duration
+	// MaxBytes stream 最大字节数。<= 0 时不限制
+	MaxBytes int64
+	// MaxMsgs stream 最大消息数。<= 0 时不限制
+	MaxMsgs int64
+	// Replicas 副本数。default: 1
+	Replicas int
+	// Storage 存储方式: file, memory。default: file
+	Storage string
+}
+
 // PublishOptions .
 type PublishOptions struct {
 	// Context ctx
 	Context context.Context
 	// Codec 序列化方式. default codec.MarshalerType_Json
 	Codec codec.Marshaler
-	// Timeout 消息推送超时时间
+	// Header 消息头。Context 中的 metadata.Metadata 和 trace id 会自动写入消息头
+	Header Header
+	// Key 消息 key。kafka 根据 key 分区, 相同 key 的消息写入同一分区, 配合 SubscribeOptions.Ordered 保证消费顺序
+	Key string
+	// Timeout 消息推送超时时间。PublishSync 等待 broker 确认的超时时间
 	Timeout time.Duration
+	// Delay 延迟发布, 消息在 Delay 后对订阅者可见
+	Delay time.Duration
+	// DeliverAt 定时发布, 消息在 DeliverAt 后对订阅者可见。与 Delay 同时设置时, 以 DeliverAt 为准。
+	// 仅 memory 原生支持, 其他 broker 需要通过 broker/scheduler 发布
+	DeliverAt time.Time
 	// caller skip
 	CallerSkip int
 }
 
+// Delayed 消息是否需要延迟发布
+func (o *PublishOptions) Delayed() bool {
+	return o.DeliverAt.After(time.Now())
+}
+
 // ParsePublishOptions .
 func ParsePublishOptions(opts ...func(o *PublishOptions)) *PublishOptions {
 	o := &PublishOptions{
+		Context:    defaultContext,
 		Codec:      json.Marshaler,
+		Header:     make(Header),
 		Timeout:    defaultReconnectWait,
 		CallerSkip: defaultCallerSkip,
 	}
@@ -54,6 +211,21 @@ func ParsePublishOptions(opts ...func(o *PublishOptions)) *PublishOptions {
 	for _, opt := range opts {
 		opt(o)
 	}
+
+	if o.Header == nil {
+		o.Header = make(Header)
+	}
+	if len(o.Key) != 0 {
+		o.Header.Set(HeaderKey, o.Key)
+	}
+	o.Header.Set(HeaderContentType, o.Codec.ContentType().String())
+	if contentEncoding := codec.ContentEncoding(o.Codec); len(contentEncoding) != 0 {
+		o.Header.Set(HeaderContentEncoding, contentEncoding)
+	}
+
+	if o.Delay > 0 && o.DeliverAt.IsZero() {
+		o.DeliverAt = time.Now().Add(o.Delay)
+	}
 	return o
 }
 
@@ -73,6 +245,22 @@ var SharedConsumption = func(clientid string, topic string) string {
 	return strings.Join([]string{topic, clientid}, ".")
 }
 
+// StartPosition 订阅的起始位置。仅在消费者首次创建, 即没有消费进度时生效
+type StartPosition int8
+
+const (
+	// StartDefault broker 默认。kafka: StartLatest; nats: StartEarliest; redis: StartLatest
+	StartDefault StartPosition = iota
+	// StartEarliest 从最早的消息开始
+	StartEarliest
+	// StartLatest 从订阅后的新消息开始
+	StartLatest
+	// StartAtTime 从 SubscribeOptions.StartTime 之后的消息开始
+	StartAtTime
+	// StartAtSequence 从 SubscribeOptions.StartSequence 开始。kafka: 每个分区的 offset; nats: stream sequence。redis 不支持
+	StartAtSequence
+)
+
 // SubscribeOptions .
 type SubscribeOptions struct {
 	// Context ctx
@@ -81,6 +269,31 @@ type SubscribeOptions struct {
 	Codec codec.Marshaler
 	// ConsumerModel 消费者模式。多副本情况下，订阅相同 topic 的消费者是否共同处理数据
 	ConsumerModel ConsumerModel
+	// MaxAttempts handler 最大执行次数。default: 1, 即不重试
+	MaxAttempts int
+	// Backoff 重试间隔。default: 不等待, 立即重试
+	Backoff Backoff
+	// DeadLetter 死信 topic。handler 执行 MaxAttempts 次后仍失败时, 消息将以 DeadLetterMessage 同步发布至该 topic,
+	// broker 确认后才确认原消息。为空时消息重新投递, 见 Discard
+	DeadLetter string
+	// Discard 未设置 DeadLetter 时, handler 执行 MaxAttempts 次后仍失败的消息在记录错误后丢弃。default: false, 消息重新投递
+	Discard bool
+	// Middlewares 作用于该订阅 handler 的中间件, 在 Options.Middlewares 之后执行
+	Middlewares []Middleware
+	// Ordered 顺序消费。相同 key 的消息依次处理, 不同 key 的消息并行处理。
+	// nats 没有分区, 顺序消费时同一 consumer 同时只处理一条消息
+	Ordered bool
+	// Concurrency 同时处理的最大消息数。达到上限时暂停消费, 直到有消息处理完成。default: 16
+	Concurrency int
+	// Start 起始位置。memory 不保存历史消息, 始终从订阅后的新消息开始。
+	// nats 的 durable consumer 已存在且起始位置不同时, 订阅失败
+	Start StartPosition
+	// StartTime 见 StartAtTime
+	StartTime time.Time
+	// StartSequence 见 StartAtSequence
+	StartSequence int64
+	// Ephemeral 临时消费者。使用独立的 consumer group, 不影响其他订阅的消费进度, 取消订阅后删除
+	Ephemeral bool
 }
 
 // ParseSubscribeOptions .
@@ -89,6 +302,43 @@ func ParseSubscribeOptions(opts ...func(o *SubscribeOptions)) *SubscribeOptions
 		Codec:         json.Marshaler,
 		Context:       defaultContext,
 		ConsumerModel: SharedConsumption,
+		MaxAttempts:   defaultMaxAttempts,
+		Concurrency:   defaultConcurrency,
+	}
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if o.Concurrency < 1 {
+		o.Concurrency = 1
+	}
+	if o.Ephemeral {
+		model, suffix := o.ConsumerModel, uuid.NewString()
+		o.ConsumerModel = func(clientid string, topic string) string {
+			return strings.Join([]string{model(clientid, topic), "ephemeral", suffix}, ".")
+		}
+	}
+	return o
+}
+
+// Responder 请求应答
+type Responder func(v interface{}, opts ...func(o *PublishOptions)) error
+
+// EventOptions .
+type EventOptions struct {
+	// Context 消息上下文。消息头中的 metadata 和 trace id 会写入 Event.Context()
+	Context context.Context
+	// Header 消息头
+	Header Header
+	// Responder 请求应答。仅在消息为请求时有效
+	Responder Responder
+}
+
+// ParseEventOptions .
+func ParseEventOptions(opts ...func(o *EventOptions)) *EventOptions {
+	o := &EventOptions{
+		Context: defaultContext,
 	}
 
 	for _, opt := range opts {
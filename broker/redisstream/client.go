@@ -0,0 +1,610 @@
+package redisstream
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/charlesbases/logger"
+
+	"github.com/charlesbases/library/broker"
+	"github.com/charlesbases/library/codec/json"
+)
+
+var (
+	// defaultMaxLen stream 保留的最大消息数(近似值)
+	defaultMaxLen int64 = 100000
+	// defaultReadBlock XREADGROUP 阻塞时间
+	defaultReadBlock = time.Second
+	// defaultPingTimeout Healthy 检查的超时时间
+	defaultPingTimeout = time.Second
+	// defaultClaimInterval 认领超时消息的检查间隔
+	defaultClaimInterval = 30 * time.Second
+	// defaultClaimIdle 消息未确认超过该时间后, 视为消费者已失效, 由其他消费者认领
+	defaultClaimIdle = time.Minute
+	// defaultInboxTTL 应答 stream 的过期时间
+	defaultInboxTTL = time.Minute
+	// inboxPrefix 应答 stream 前缀
+	inboxPrefix = "_inbox:"
+)
+
+const (
+	// fieldHeader stream 消息中的消息头字段
+	fieldHeader = "header"
+	// fieldData stream 消息中的消息体字段
+	fieldData = "data"
+)
+
+// client .
+type client struct {
+	id   string
+	opts *broker.Options
+
+	// consumer 消费者名称, 同一 consumer group 内唯一
+	consumer string
+
+	rdb redis.Cmdable
+
+	actived atomic.Bool
+	closing chan struct{}
+}
+
+// values 编码 stream 消息
+func values(data []byte, header broker.Header) (map[string]interface{}, error) {
+	h, err := json.Marshaler.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{fieldHeader: h, fieldData: data}, nil
+}
+
+// decode 解码 stream 消息
+func decode(msg redis.XMessage) (data []byte, header broker.Header) {
+	header = make(broker.Header)
+	if h, ok := msg.Values[fieldHeader].(string); ok {
+		json.Marshaler.Unmarshal([]byte(h), &header)
+	}
+	if d, ok := msg.Values[fieldData].(string); ok {
+		data = []byte(d)
+	}
+	return data, header
+}
+
+// xaddArgs .
+func xaddArgs(stream string, data []byte, header broker.Header) (*redis.XAddArgs, error) {
+	vals, err := values(data, header)
+	if err != nil {
+		return nil, err
+	}
+
+	return &redis.XAddArgs{
+		Stream: stream,
+		MaxLen: defaultMaxLen,
+		Approx: true,
+		Values: vals,
+	}, nil
+}
+
+// add .
+func (c *client) add(ctx context.Context, stream string, data []byte, header broker.Header, timeout time.Duration) (string, error) {
+	args, err := xaddArgs(stream, data, header)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	return c.rdb.XAdd(ctx, args).Result()
+}
+
+// prepare 检查发布条件
+func (c *client) prepare(topic string, o *broker.PublishOptions) error {
+	if !c.actived.Load() {
+		return broker.ErrNotReady
+	}
+
+	if o.Delayed() {
+		return broker.ErrDelayNotSupported
+	}
+
+	return broker.CheckSubject(topic)
+}
+
+// publish .
+func (c *client) publish(topic string, v interface{}, o *broker.PublishOptions) (string, error) {
+	if err := c.prepare(topic, o); err != nil {
+		return "", err
+	}
+
+	data, err := broker.Marshal(c.id, v, o.Codec)
+	if err != nil {
+		return "", err
+	}
+
+	id, err := c.add(o.Context, topic, data, broker.Inject(o.Context, o.Header), o.Timeout)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return "", broker.ErrPublishTimeout
+		}
+		return "", err
+	}
+
+	logger.CallerSkip(o.CallerSkip+1).Context(o.Context).Debugf(`[redis]: publish["%s"]: id: %s: %s`, topic, id, o.Codec.RawMessage(data))
+	return id, nil
+}
+
+// Publish .
+func (c *client) Publish(topic string, v interface{}, opts ...func(o *broker.PublishOptions)) error {
+	_, err := c.publish(topic, v, broker.ParsePublishOptions(opts...))
+	broker.ObservePublish(topic, err)
+	return errors.Wrapf(err, `[redis]: publish["%s"]`, topic)
+}
+
+// PublishSync XADD 返回时消息已写入 stream
+func (c *client) PublishSync(topic string, v interface{}, opts ...func(o *broker.PublishOptions)) (*broker.Receipt, error) {
+	id, err := c.publish(topic, v, broker.ParsePublishOptions(opts...))
+	broker.ObservePublish(topic, err)
+	if err != nil {
+		return nil, errors.Wrapf(err, `[redis]: publish["%s"]`, topic)
+	}
+	return &broker.Receipt{Topic: topic, Stream: topic, ID: id}, nil
+}
+
+// publishBatch 通过 pipeline 写入全部消息
+func (c *client) publishBatch(topic string, vs []interface{}, o *broker.PublishOptions) ([]broker.Result, error) {
+	if err := c.prepare(topic, o); err != nil {
+		return nil, err
+	}
+
+	var header = broker.Inject(o.Context, o.Header)
+	var results = make([]broker.Result, len(vs))
+	var cmds = make([]*redis.StringCmd, len(vs))
+
+	ctx, cancel := context.WithTimeout(o.Context, o.Timeout)
+	defer cancel()
+
+	// 单条命令的错误从 cmds 中获取
+	c.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, v := range vs {
+			data, err := broker.Marshal(c.id, v, o.Codec)
+			if err != nil {
+				results[i].Err = err
+				continue
+			}
+
+			args, err := xaddArgs(topic, data, header)
+			if err != nil {
+				results[i].Err = err
+				continue
+			}
+			cmds[i] = pipe.XAdd(ctx, args)
+		}
+		return nil
+	})
+
+	var failed int
+	for i, cmd := range cmds {
+		if cmd != nil {
+			if id, err := cmd.Result(); err != nil {
+				if errors.Is(err, context.DeadlineExceeded) {
+					err = broker.ErrPublishTimeout
+				}
+				results[i].Err = err
+			} else {
+				results[i].Receipt = &broker.Receipt{Topic: topic, Stream: topic, ID: id}
+			}
+		}
+
+		if results[i].Err != nil {
+			failed++
+		}
+		broker.ObservePublish(topic, results[i].Err)
+	}
+
+	logger.CallerSkip(o.CallerSkip+1).Context(o.Context).Debugf(`[redis]: publish["%s"]: batch: %d, failed: %d`, topic, len(vs), failed)
+	return results, nil
+}
+
+// PublishBatch .
+func (c *client) PublishBatch(topic string, vs []interface{}, opts ...func(o *broker.PublishOptions)) ([]broker.Result, error) {
+	results, err := c.publishBatch(topic, vs, broker.ParsePublishOptions(opts...))
+	return results, errors.Wrapf(err, `[redis]: publish["%s"]`, topic)
+}
+
+// request 通过临时 stream 接收应答
+func (c *client) request(topic string, v interface{}, timeout time.Duration, opts ...func(o *broker.PublishOptions)) (broker.Event, error) {
+	var o = broker.ParsePublishOptions(opts...)
+
+	var inbox = inboxPrefix + uuid.NewString()
+	defer c.rdb.Del(context.Background(), inbox)
+
+	o.Header = o.Header.Clone()
+	o.Header.Set(broker.HeaderReplyTo, inbox)
+
+	if _, err := c.publish(topic, v, o); err != nil {
+		return nil, err
+	}
+
+	streams, err := c.rdb.XRead(
+		o.Context, &redis.XReadArgs{
+			Streams: []string{inbox, "0"},
+			Count:   1,
+			Block:   timeout,
+		},
+	).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, broker.ErrRequestTimeout
+		}
+		return nil, err
+	}
+
+	for _, stream := range streams {
+		for _, msg := range stream.Messages {
+			data, header := decode(msg)
+
+			event := broker.NewEvent(topic, "", data, o.Codec, func(eo *broker.EventOptions) {
+				eo.Context = o.Context
+				eo.Header = header
+			})
+
+			logger.Context(o.Context).Debugf(`[redis]: request["%s"]: reply: %s`, topic, event.Codec().RawMessage(data))
+			return event, nil
+		}
+	}
+	return nil, broker.ErrRequestTimeout
+}
+
+// Request .
+func (c *client) Request(topic string, v interface{}, timeout time.Duration, opts ...func(o *broker.PublishOptions)) (broker.Event, error) {
+	event, err := c.request(topic, v, timeout, opts...)
+	return event, errors.Wrapf(err, `[redis]: request["%s"]`, topic)
+}
+
+// responder 应答至请求方的临时 stream
+func (c *client) responder(reply string) func(o *broker.EventOptions) {
+	return func(o *broker.EventOptions) {
+		if len(reply) == 0 {
+			return
+		}
+
+		o.Responder = func(v interface{}, opts ...func(o *broker.PublishOptions)) error {
+			var po = broker.ParsePublishOptions(opts...)
+
+			data, err := broker.Marshal(c.id, v, po.Codec)
+			if err != nil {
+				return errors.Wrapf(err, `[redis]: respond["%s"]`, reply)
+			}
+
+			logger.Context(po.Context).Debugf(`[redis]: respond["%s"]: %s`, reply, po.Codec.RawMessage(data))
+			if _, err := c.add(po.Context, reply, data, broker.Inject(po.Context, po.Header), po.Timeout); err != nil {
+				return errors.Wrapf(err, `[redis]: respond["%s"]`, reply)
+			}
+
+			// 请求方超时退出时, 应答 stream 自动过期
+			c.rdb.Expire(po.Context, reply, defaultInboxTTL)
+			return nil
+		}
+	}
+}
+
+// subscription .
+type subscription struct {
+	client *client
+
+	topic string
+	group string
+	opts  *broker.SubscribeOptions
+
+	h broker.Handler
+
+	cancel   context.CancelFunc
+	draining bool
+	closing  chan struct{}
+	closed   chan struct{}
+	once     sync.Once
+
+	dispatcher *broker.Dispatcher
+}
+
+// Topic .
+func (s *subscription) Topic() string {
+	return s.topic
+}
+
+// stop .
+func (s *subscription) stop(drain bool) {
+	s.once.Do(func() {
+		s.draining = drain
+		close(s.closing)
+
+		if !drain {
+			s.cancel()
+		}
+	})
+	<-s.closed
+}
+
+// Unsubscribe 未确认的消息保留在 consumer group 中, 由其他消费者认领
+func (s *subscription) Unsubscribe() error {
+	logger.Debugf(`[redis]: unsubscribe["%s"]`, s.topic)
+
+	s.stop(false)
+	return nil
+}
+
+// Drain .
+func (s *subscription) Drain() error {
+	logger.Debugf(`[redis]: drain["%s"]`, s.topic)
+
+	s.stop(true)
+	return nil
+}
+
+// stopped .
+func (s *subscription) stopped() bool {
+	select {
+	case <-s.closing:
+		return true
+	case <-s.client.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// consume 处理消息。handler 执行成功或进入死信后确认消息, 否则消息保持未确认状态, 超时后重新投递
+func (s *subscription) consume(msg redis.XMessage) bool {
+	// 已被删除的消息
+	if len(msg.Values) == 0 {
+		s.client.rdb.XAck(s.opts.Context, s.topic, s.group, msg.ID)
+		return true
+	}
+
+	var data, header = decode(msg)
+	var reply = header.Get(broker.HeaderReplyTo)
+
+	var event = broker.NewEvent(
+		s.topic, reply, data, s.opts.Codec, func(eo *broker.EventOptions) {
+			eo.Context = s.opts.Context
+			eo.Header = header
+		}, s.client.responder(reply),
+	)
+
+	logger.Context(event.Context()).Debugf(`[redis]: consume["%s"]: %s`, s.topic, event.Codec().RawMessage(data))
+
+	return s.dispatcher.Dispatch(event.Key(), func() {
+		ack, err := broker.Retry(
+			s.client, event,
+			func(ctx context.Context, event broker.Event) error {
+				// 重置消息的空闲时间, 避免重试期间被其他消费者认领
+				s.client.rdb.XClaimJustID(
+					ctx, &redis.XClaimArgs{
+						Stream:   s.topic,
+						Group:    s.group,
+						Consumer: s.client.consumer,
+						Messages: []string{msg.ID},
+					},
+				)
+				return s.h(ctx, event)
+			}, s.opts,
+		)
+		if err != nil {
+			logger.Context(event.Context()).Errorf(`[redis]: consume["%s"]: %v`, s.topic, err)
+		}
+
+		if ack {
+			if err := s.client.rdb.XAck(context.Background(), s.topic, s.group, msg.ID).Err(); err != nil {
+				logger.Context(event.Context()).Errorf(`[redis]: ack["%s"]: %s: %v`, s.topic, msg.ID, err)
+			}
+		}
+	})
+}
+
+// claim 认领其他消费者超时未确认的消息
+func (s *subscription) claim() {
+	var start = "0-0"
+	for !s.stopped() {
+		msgs, next, err := s.client.rdb.XAutoClaim(
+			s.opts.Context, &redis.XAutoClaimArgs{
+				Stream:   s.topic,
+				Group:    s.group,
+				Consumer: s.client.consumer,
+				MinIdle:  defaultClaimIdle,
+				Start:    start,
+				Count:    int64(s.opts.Concurrency),
+			},
+		).Result()
+		if err != nil {
+			if s.opts.Context.Err() == nil {
+				logger.Errorf(`[redis]: claim["%s"]: %v`, s.topic, err)
+			}
+			return
+		}
+
+		for _, msg := range msgs {
+			if !s.consume(msg) {
+				return
+			}
+		}
+
+		if next == "0-0" {
+			return
+		}
+		start = next
+	}
+}
+
+// read .
+func (s *subscription) read() error {
+	streams, err := s.client.rdb.XReadGroup(
+		s.opts.Context, &redis.XReadGroupArgs{
+			Group:    s.group,
+			Consumer: s.client.consumer,
+			Streams:  []string{s.topic, ">"},
+			Count:    int64(s.opts.Concurrency),
+			Block:    defaultReadBlock,
+		},
+	).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil
+		}
+		return err
+	}
+
+	for _, stream := range streams {
+		for _, msg := range stream.Messages {
+			if !s.consume(msg) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// run .
+func (s *subscription) run() {
+	defer close(s.closed)
+	defer s.cancel()
+
+	// 启动时认领失效消费者遗留的消息
+	s.claim()
+
+	t := time.NewTicker(defaultClaimInterval)
+	defer t.Stop()
+
+	for !s.stopped() {
+		select {
+		case <-t.C:
+			s.claim()
+		default:
+		}
+
+		if err := s.read(); err != nil && s.opts.Context.Err() == nil {
+			logger.Errorf(`[redis]: consume["%s"]: %v`, s.topic, err)
+
+			select {
+			case <-time.NewTimer(s.client.opts.ReconnectWait).C:
+			case <-s.closing:
+			case <-s.client.closing:
+			}
+		}
+	}
+
+	// Drain 时等待已接收的消息处理完成
+	if s.draining {
+		s.dispatcher.Wait()
+	}
+
+	// 删除临时消费者的 consumer group
+	if s.opts.Ephemeral {
+		if err := s.client.rdb.XGroupDestroy(context.Background(), s.topic, s.group).Err(); err != nil {
+			logger.Errorf(`[redis]: destroy consumer group["%s"]: %v`, s.group, err)
+		}
+	}
+}
+
+// subscribe .
+func (c *client) subscribe(topic string, handler broker.Handler, opts ...func(o *broker.SubscribeOptions)) (broker.Subscription, error) {
+	if !c.actived.Load() {
+		return nil, broker.ErrNotReady
+	}
+
+	if err := broker.CheckSubject(topic); err != nil {
+		return nil, err
+	}
+
+	logger.Debugf(`[redis]: subscribe["%s"]`, topic)
+
+	var o = broker.ParseSubscribeOptions(opts...)
+	var group = o.ConsumerModel(c.id, topic)
+
+	var start = "$"
+	switch o.Start {
+	case broker.StartDefault, broker.StartLatest:
+	case broker.StartEarliest:
+		start = "0"
+	case broker.StartAtTime:
+		// consumer group 从该 id 之后的消息开始消费
+		start = strconv.FormatInt(o.StartTime.UnixMilli()-1, 10) + "-" + strconv.FormatUint(math.MaxUint64, 10)
+	default:
+		return nil, broker.ErrStartNotSupported
+	}
+
+	// consumer group 已存在时忽略
+	if err := c.rdb.XGroupCreateMkStream(o.Context, topic, group, start).Err(); err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(o.Context)
+	o.Context = ctx
+
+	sub := &subscription{
+		client:  c,
+		topic:   topic,
+		group:   group,
+		opts:    o,
+		h:       broker.WrapHandler(handler, c.opts, o),
+		cancel:  cancel,
+		closing: make(chan struct{}),
+		closed:  make(chan struct{}),
+
+		dispatcher: broker.NewDispatcher(o),
+	}
+
+	go sub.run()
+
+	return sub, nil
+}
+
+// Subscribe .
+func (c *client) Subscribe(topic string, handler broker.Handler, opts ...func(o *broker.SubscribeOptions)) (broker.Subscription, error) {
+	sub, err := c.subscribe(topic, handler, opts...)
+	return sub, errors.Wrapf(err, `[redis]: subscribe["%s"]`, topic)
+}
+
+// Healthy .
+func (c *client) Healthy() bool {
+	if !c.actived.Load() {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultPingTimeout)
+	defer cancel()
+	return c.rdb.Ping(ctx).Err() == nil
+}
+
+// Close 不会关闭 redis 连接, 连接由调用方管理
+func (c *client) Close() {
+	if c.actived.CompareAndSwap(true, false) {
+		close(c.closing)
+	}
+}
+
+// NewClient 使用已有的 redis 连接创建 broker.Client
+func NewClient(id string, rdb redis.Cmdable, opts ...func(o *broker.Options)) (broker.Client, error) {
+	if rdb == nil {
+		return nil, broker.ErrNotReady
+	}
+
+	c := &client{
+		id:       id,
+		opts:     broker.ParseOptions(opts...),
+		consumer: strings.Join([]string{id, uuid.NewString()}, "."),
+		rdb:      rdb,
+		closing:  make(chan struct{}),
+	}
+	c.actived.Store(true)
+	return c, nil
+}
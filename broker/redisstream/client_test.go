@@ -0,0 +1,60 @@
+package redisstream
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/charlesbases/logger"
+
+	"github.com/charlesbases/library"
+	"github.com/charlesbases/library/broker"
+)
+
+func Test(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr:     "10.63.2.46:6379",
+		Password: "admin123456..",
+	})
+	defer rdb.Close()
+
+	c, err := NewClient("test."+uuid.NewString(), rdb)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	defer c.Close()
+
+	var topic = "ticker"
+
+	// Subscribe
+	c.Subscribe(topic, func(ctx context.Context, event broker.Event) error {
+		var timestr string
+		if err := event.Unmarshal(&timestr); err != nil {
+			return err
+		}
+		fmt.Println(timestr)
+		return event.Respond(timestr)
+	})
+
+	// Request
+	go func() {
+		for {
+			event, err := c.Request(topic, library.NowString(), time.Second, func(o *broker.PublishOptions) {
+				o.Context = context.WithValue(context.Background(), library.HeaderTraceID, uuid.NewString())
+			})
+			if err != nil {
+				logger.Error(err)
+			} else {
+				fmt.Println("reply:", string(event.Body()))
+			}
+
+			<-time.NewTimer(time.Second * 10).C
+		}
+	}()
+
+	<-time.NewTimer(time.Minute).C
+}
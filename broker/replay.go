@@ -0,0 +1,22 @@
+package broker
+
+import "time"
+
+// Replay 重新处理 topic 中 since 之后的消息, 如修复 bug 后重新处理事件。
+// 使用临时消费者(SubscribeOptions.Ephemeral), 不影响已有订阅的消费进度。处理完成后调用 Subscription.Unsubscribe 结束重放。
+// memory 不保存历史消息, 无法重放; nats 的 stream 需保留已确认的消息, 即不能使用 WorkQueuePolicy
+func Replay(c Client, topic string, since time.Time, handler Handler, opts ...func(o *SubscribeOptions)) (Subscription, error) {
+	if c == nil {
+		return nil, ErrNotReady
+	}
+
+	return c.Subscribe(
+		topic, handler, append(
+			opts, func(o *SubscribeOptions) {
+				o.Start = StartAtTime
+				o.StartTime = since
+				o.Ephemeral = true
+			},
+		)...,
+	)
+}
@@ -0,0 +1,129 @@
+package broker
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/charlesbases/library"
+)
+
+// Backoff 重试间隔。attempt 为已执行次数, 从 1 开始
+type Backoff func(attempt int) time.Duration
+
+// ConstantBackoff 固定重试间隔
+func ConstantBackoff(d time.Duration) Backoff {
+	return func(attempt int) time.Duration {
+		return d
+	}
+}
+
+// ExponentialBackoff 指数重试间隔: base * 2^(attempt-1), 最大不超过 max
+func ExponentialBackoff(base time.Duration, max time.Duration) Backoff {
+	return func(attempt int) time.Duration {
+		var d = base
+		for i := 1; i < attempt && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			return max
+		}
+		return d
+	}
+}
+
+// Jitter 为 b 加入随机抖动, 实际间隔在 [d/2, d) 之间, 避免多个客户端同时重试
+func Jitter(b Backoff) Backoff {
+	return func(attempt int) time.Duration {
+		var d = b(attempt)
+		if d < 2 {
+			return d
+		}
+
+		half := d / 2
+		return half + time.Duration(rand.Int63n(int64(d-half)))
+	}
+}
+
+// DeadLetterMessage 死信消息
+type DeadLetterMessage struct {
+	// Topic 原始 topic
+	Topic string `json:"topic"`
+	// Reason 最后一次执行失败的原因
+	Reason string `json:"reason"`
+	// Attempts 执行次数
+	Attempts int `json:"attempts"`
+	// ContentType 原始消息格式
+	ContentType string `json:"content_type"`
+	// ContentEncoding 原始消息编码(如压缩、加密)
+	ContentEncoding string `json:"content_encoding,omitempty"`
+	// Body 原始消息
+	Body []byte `json:"body"`
+	// FailedAt 进入死信的时间
+	FailedAt string `json:"failed_at"`
+}
+
+// Retry 执行 handler, 失败时按照 SubscribeOptions.Backoff 重试, 最多执行 SubscribeOptions.MaxAttempts 次。
+// 全部失败后, 若设置了 SubscribeOptions.DeadLetter, 则将消息同步发布至死信 topic。
+//
+// 返回值 ack 表示消息是否可以确认: handler 执行成功、死信已由 broker 确认, 或设置了 SubscribeOptions.Discard(消息丢弃)。
+// 死信发布失败、未设置死信 topic、handler 最后一次返回 ErrRedeliver 或 SubscribeOptions.Context 结束时, ack 为 false, 消息应重新投递。
+func Retry(c Client, event Event, handler Handler, o *SubscribeOptions) (ack bool, err error) {
+	consumed.WithLabelValues(event.Topic()).Inc()
+
+	var attempts = o.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var attempt int
+	var last error
+	for attempt = 1; ; attempt++ {
+		if last = handler(event.Context(), event); last == nil {
+			return true, nil
+		}
+
+		if attempt >= attempts {
+			break
+		}
+
+		if o.Backoff != nil {
+			select {
+			case <-o.Context.Done():
+				return false, errors.Wrapf(last, "attempts: %d", attempt)
+			case <-time.NewTimer(o.Backoff(attempt)).C:
+			}
+		}
+	}
+
+	err = errors.Wrapf(last, "attempts: %d", attempt)
+	if errors.Is(last, ErrRedeliver) {
+		return false, err
+	}
+	if len(o.DeadLetter) == 0 {
+		return o.Discard, err
+	}
+
+	var contentType = event.Header().Get(HeaderContentType)
+	if len(contentType) == 0 {
+		contentType = o.Codec.ContentType().String()
+	}
+
+	if _, e := c.PublishSync(
+		o.DeadLetter, &DeadLetterMessage{
+			Topic:           event.Topic(),
+			Reason:          last.Error(),
+			Attempts:        attempt,
+			ContentType:     contentType,
+			ContentEncoding: event.Header().Get(HeaderContentEncoding),
+			Body:            event.Body(),
+			FailedAt:        library.NowString(),
+		}, func(po *PublishOptions) {
+			po.Context = event.Context()
+		},
+	); e != nil {
+		return false, errors.Wrapf(err, "dead letter: %v", e)
+	}
+	return true, errors.Wrapf(err, `dead letter["%s"]`, o.DeadLetter)
+}
@@ -0,0 +1,275 @@
+package scheduler
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/charlesbases/logger"
+
+	"github.com/charlesbases/library/broker"
+	"github.com/charlesbases/library/codec/json"
+)
+
+var (
+	// defaultKey 延迟消息的 redis sorted set
+	defaultKey = "broker_scheduled"
+	// defaultInterval 默认轮询间隔
+	defaultInterval = time.Second
+	// defaultBatchSize 每次轮询默认投递的最大消息数
+	defaultBatchSize = 100
+	// defaultLease 消息被取出后的租期。租期内未投递成功的消息将被重新取出
+	defaultLease = 30 * time.Second
+)
+
+// claim 取出到期的消息, 并将其 score 延后至租期结束, 避免被其他副本重复取出
+var claim = redis.NewScript(`
+local items = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[3])
+for _, item in ipairs(items) do
+	redis.call('ZADD', KEYS[1], ARGV[2], item)
+end
+return items
+`)
+
+// Options .
+type Options struct {
+	// Key 延迟消息的 redis sorted set。default: broker_scheduled
+	Key string
+	// Interval 轮询间隔。default: 1s
+	Interval time.Duration
+	// BatchSize 每次轮询投递的最大消息数。default: 100
+	BatchSize int
+	// Lease 消息被取出后的租期, 租期内未投递成功的消息将被重新投递。default: 30s
+	Lease time.Duration
+}
+
+// entry 延迟消息
+type entry struct {
+	// ID 唯一标识, 保证 sorted set 中的 member 不重复
+	ID string `json:"id"`
+	// Topic .
+	Topic string `json:"topic"`
+	// ContentType 消息格式
+	ContentType string `json:"content_type"`
+	// Header 消息头
+	Header broker.Header `json:"header"`
+	// Body 已编码的消息
+	Body []byte `json:"body"`
+}
+
+// client 在 broker.Client 之上实现延迟发布。
+// 设置了 PublishOptions.Delay 或 PublishOptions.DeliverAt 的消息写入 redis sorted set, 到期后由 client 发布,
+// 其余调用直接交由 broker.Client 处理
+type client struct {
+	broker.Client
+
+	id   string
+	rdb  redis.Cmdable
+	opts *Options
+
+	closing chan struct{}
+	closed  chan struct{}
+}
+
+// score .
+func score(t time.Time) string {
+	return strconv.FormatInt(t.UnixMilli(), 10)
+}
+
+// schedule 写入延迟消息
+func (c *client) schedule(topic string, v interface{}, o *broker.PublishOptions) error {
+	if err := broker.CheckSubject(topic); err != nil {
+		return err
+	}
+
+	data, err := broker.Marshal(c.id, v, o.Codec)
+	if err != nil {
+		return err
+	}
+
+	member, err := json.Marshaler.Marshal(
+		&entry{
+			ID:          uuid.NewString(),
+			Topic:       topic,
+			ContentType: o.Codec.ContentType().String(),
+			Header:      broker.Inject(o.Context, o.Header),
+			Body:        data,
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := c.rdb.ZAdd(o.Context, c.opts.Key, redis.Z{Score: float64(o.DeliverAt.UnixMilli()), Member: member}).Err(); err != nil {
+		return err
+	}
+
+	logger.CallerSkip(o.CallerSkip+1).Context(o.Context).Debugf(`[scheduler]: publish["%s"]: deliver at %s: %s`, topic, o.DeliverAt.Format(time.RFC3339), o.Codec.RawMessage(data))
+	return nil
+}
+
+// Publish .
+func (c *client) Publish(topic string, v interface{}, opts ...func(o *broker.PublishOptions)) error {
+	var o = broker.ParsePublishOptions(opts...)
+	if !o.Delayed() {
+		return c.Client.Publish(topic, v, opts...)
+	}
+	return errors.Wrapf(c.schedule(topic, v, o), `[scheduler]: publish["%s"]`, topic)
+}
+
+// PublishSync 延迟消息在写入 redis 后返回, 回执中只有 topic
+func (c *client) PublishSync(topic string, v interface{}, opts ...func(o *broker.PublishOptions)) (*broker.Receipt, error) {
+	var o = broker.ParsePublishOptions(opts...)
+	if !o.Delayed() {
+		return c.Client.PublishSync(topic, v, opts...)
+	}
+
+	if err := c.schedule(topic, v, o); err != nil {
+		return nil, errors.Wrapf(err, `[scheduler]: publish["%s"]`, topic)
+	}
+	return &broker.Receipt{Topic: topic}, nil
+}
+
+// PublishBatch 延迟消息逐条写入 redis
+func (c *client) PublishBatch(topic string, vs []interface{}, opts ...func(o *broker.PublishOptions)) ([]broker.Result, error) {
+	var o = broker.ParsePublishOptions(opts...)
+	if !o.Delayed() {
+		return c.Client.PublishBatch(topic, vs, opts...)
+	}
+
+	if err := broker.CheckSubject(topic); err != nil {
+		return nil, errors.Wrapf(err, `[scheduler]: publish["%s"]`, topic)
+	}
+
+	var results = make([]broker.Result, len(vs))
+	for i, v := range vs {
+		if err := c.schedule(topic, v, o); err != nil {
+			results[i].Err = err
+		} else {
+			results[i].Receipt = &broker.Receipt{Topic: topic}
+		}
+	}
+	return results, nil
+}
+
+// deliver 投递到期的消息。返回取出的消息数
+func (c *client) deliver() (int, error) {
+	var now = time.Now()
+
+	items, err := claim.Run(
+		context.Background(), c.rdb, []string{c.opts.Key},
+		score(now), score(now.Add(c.opts.Lease)), c.opts.BatchSize,
+	).StringSlice()
+	if err != nil {
+		if err == redis.Nil {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	for _, item := range items {
+		var e = new(entry)
+		if err := json.Marshaler.Unmarshal([]byte(item), e); err != nil {
+			logger.Errorf(`[scheduler]: deliver: invalid message: %v`, err)
+			c.rdb.ZRem(context.Background(), c.opts.Key, item)
+			continue
+		}
+
+		// 投递失败的消息在租期结束后重新投递
+		if _, err := c.Client.PublishSync(
+			e.Topic, broker.Raw(e.Body), func(o *broker.PublishOptions) {
+				o.Context = broker.Extract(context.Background(), e.Header)
+				o.Codec = broker.LookupCodec(e.ContentType)
+				o.Header = e.Header
+			},
+		); err != nil {
+			logger.Errorf(`[scheduler]: deliver["%s"]: %v`, e.Topic, err)
+			continue
+		}
+
+		if err := c.rdb.ZRem(context.Background(), c.opts.Key, item).Err(); err != nil {
+			logger.Errorf(`[scheduler]: deliver["%s"]: %v`, e.Topic, err)
+		}
+	}
+	return len(items), nil
+}
+
+// run .
+func (c *client) run() {
+	defer close(c.closed)
+
+	t := time.NewTicker(c.opts.Interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.closing:
+			return
+		case <-t.C:
+		}
+
+		// 取出的消息数达到 BatchSize 时, 可能仍有到期的消息
+		for {
+			n, err := c.deliver()
+			if err != nil {
+				logger.Errorf(`[scheduler]: deliver: %v`, err)
+			}
+			if err != nil || n < c.opts.BatchSize {
+				break
+			}
+
+			select {
+			case <-c.closing:
+				return
+			default:
+			}
+		}
+	}
+}
+
+// Close 停止投递, 并关闭 broker.Client。未到期的消息保留在 redis 中, 重启后继续投递
+func (c *client) Close() {
+	select {
+	case <-c.closing:
+	default:
+		close(c.closing)
+		<-c.closed
+	}
+
+	c.Client.Close()
+}
+
+// NewClient 使用 redis sorted set 为 broker.Client 提供延迟发布。id 为消息的 producer
+func NewClient(id string, c broker.Client, rdb redis.Cmdable, opts ...func(o *Options)) (broker.Client, error) {
+	if c == nil || rdb == nil {
+		return nil, broker.ErrNotReady
+	}
+
+	o := &Options{
+		Key:       defaultKey,
+		Interval:  defaultInterval,
+		BatchSize: defaultBatchSize,
+		Lease:     defaultLease,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	sc := &client{
+		Client:  c,
+		id:      id,
+		rdb:     rdb,
+		opts:    o,
+		closing: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+
+	go sc.run()
+
+	return sc, nil
+}
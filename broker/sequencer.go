@@ -0,0 +1,50 @@
+package broker
+
+import "sync"
+
+// sequencer 按 key 调度任务: 相同 key 的任务按提交顺序依次执行, 不同 key 的任务并行执行
+type sequencer struct {
+	queues map[string][]func()
+	lock   sync.Mutex
+}
+
+// newSequencer .
+func newSequencer() *sequencer {
+	return &sequencer{queues: make(map[string][]func())}
+}
+
+// Go 提交任务。key 为空时任务直接并行执行
+func (s *sequencer) Go(key string, fn func()) {
+	if len(key) == 0 {
+		go fn()
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// 该 key 已有任务在执行, 排队等待
+	if queue, found := s.queues[key]; found {
+		s.queues[key] = append(queue, fn)
+		return
+	}
+
+	s.queues[key] = nil
+	go s.run(key, fn)
+}
+
+// run 依次执行 key 的任务, 队列为空时退出
+func (s *sequencer) run(key string, fn func()) {
+	for fn != nil {
+		fn()
+
+		s.lock.Lock()
+		if queue := s.queues[key]; len(queue) != 0 {
+			fn, s.queues[key] = queue[0], queue[1:]
+		} else {
+			fn = nil
+			delete(s.queues, key)
+		}
+		s.lock.Unlock()
+	}
+}
@@ -0,0 +1,158 @@
+package broker
+
+import (
+	"context"
+	"reflect"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/runtime/protoiface"
+
+	"github.com/charlesbases/library/codec"
+	"github.com/charlesbases/library/codec/json"
+	protocodec "github.com/charlesbases/library/codec/proto"
+)
+
+// protoMessage proto.Message, 包括 github.com/golang/protobuf 生成的旧版消息
+var protoMessage = reflect.TypeOf((*protoiface.MessageV1)(nil)).Elem()
+
+// TopicOptions .
+type TopicOptions struct {
+	// Client 为 nil 时, 在调用时使用默认 client C
+	Client Client
+}
+
+// Topic 消息类型为 T 的 topic。T 实现 proto.Message 时使用 proto 编码, 否则使用 json 编码。
+//
+//	var OrderCreated = broker.NewTopic[*pb.Order]("orders.created")
+//
+//	OrderCreated.Publish(ctx, order)
+//	OrderCreated.Subscribe(func(ctx context.Context, order *pb.Order, event broker.Event) error { ... })
+type Topic[T any] struct {
+	name   string
+	client Client
+	codec  codec.Marshaler
+
+	// elem T 为指针时, 解码前需创建的值类型
+	elem reflect.Type
+}
+
+// NewTopic .
+func NewTopic[T any](name string, opts ...func(o *TopicOptions)) *Topic[T] {
+	var o = new(TopicOptions)
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	var t = &Topic[T]{name: name, client: o.Client, codec: json.Marshaler}
+
+	typ := reflect.TypeOf((*T)(nil)).Elem()
+	if typ.Kind() == reflect.Pointer {
+		t.elem = typ.Elem()
+	}
+	if typ.Implements(protoMessage) {
+		t.codec = protocodec.Marshaler
+
+		// 日志中以 protojson 格式输出消息
+		if t.elem != nil {
+			if m, ok := reflect.New(t.elem).Interface().(proto.Message); ok {
+				t.codec = protocodec.NewMessageMarshaler(m)
+			}
+		}
+	}
+	return t
+}
+
+// Name .
+func (t *Topic[T]) Name() string {
+	return t.name
+}
+
+// c .
+func (t *Topic[T]) c() (Client, error) {
+	if t.client != nil {
+		return t.client, nil
+	}
+	if C != nil {
+		return C, nil
+	}
+	return nil, ErrNotReady
+}
+
+// publishOptions Codec 与 Context 在 opts 之前设置, 可被 opts 覆盖
+func (t *Topic[T]) publishOptions(ctx context.Context, opts []func(o *PublishOptions)) []func(o *PublishOptions) {
+	return append(
+		[]func(o *PublishOptions){
+			func(o *PublishOptions) {
+				o.Context = ctx
+				o.Codec = t.codec
+				o.CallerSkip++
+			},
+		}, opts...,
+	)
+}
+
+// Publish .
+func (t *Topic[T]) Publish(ctx context.Context, v T, opts ...func(o *PublishOptions)) error {
+	c, err := t.c()
+	if err != nil {
+		return err
+	}
+	return c.Publish(t.name, v, t.publishOptions(ctx, opts)...)
+}
+
+// PublishSync .
+func (t *Topic[T]) PublishSync(ctx context.Context, v T, opts ...func(o *PublishOptions)) (*Receipt, error) {
+	c, err := t.c()
+	if err != nil {
+		return nil, err
+	}
+	return c.PublishSync(t.name, v, t.publishOptions(ctx, opts)...)
+}
+
+// PublishBatch .
+func (t *Topic[T]) PublishBatch(ctx context.Context, vs []T, opts ...func(o *PublishOptions)) ([]Result, error) {
+	c, err := t.c()
+	if err != nil {
+		return nil, err
+	}
+
+	var items = make([]interface{}, len(vs))
+	for i, v := range vs {
+		items[i] = v
+	}
+	return c.PublishBatch(t.name, items, t.publishOptions(ctx, opts)...)
+}
+
+// decode .
+func (t *Topic[T]) decode(event Event) (T, error) {
+	var v T
+	if t.elem != nil {
+		v = reflect.New(t.elem).Interface().(T)
+		return v, event.Unmarshal(v)
+	}
+	return v, event.Unmarshal(&v)
+}
+
+// Subscribe 订阅消息, 解码为 T 后交由 handler 处理。解码失败时返回错误, 按 SubscribeOptions 重试或进入死信
+func (t *Topic[T]) Subscribe(handler func(ctx context.Context, v T, event Event) error, opts ...func(o *SubscribeOptions)) (Subscription, error) {
+	c, err := t.c()
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Subscribe(
+		t.name, func(ctx context.Context, event Event) error {
+			v, err := t.decode(event)
+			if err != nil {
+				return err
+			}
+			return handler(ctx, v, event)
+		}, append(
+			[]func(o *SubscribeOptions){
+				func(o *SubscribeOptions) {
+					o.Codec = t.codec
+				},
+			}, opts...,
+		)...,
+	)
+}
@@ -0,0 +1,71 @@
+package cbor
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+
+	"github.com/charlesbases/library/codec"
+	"github.com/charlesbases/library/content"
+)
+
+// Marshaler default codec.Marshaler
+var Marshaler = NewMarshaler()
+
+func init() {
+	codec.Register(Marshaler)
+}
+
+// raw RawMessage 使用的解码方式。map 解码为 map[string]interface{}, 以便转换为 json
+var raw, _ = cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]interface{}(nil))}.DecMode()
+
+type cborMarshaler struct {
+	*codec.MarshalOptions
+}
+
+// NewMarshaler .
+func NewMarshaler(opts ...func(o *codec.MarshalOptions)) codec.Marshaler {
+	var options = new(codec.MarshalOptions)
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	return &cborMarshaler{MarshalOptions: options}
+}
+
+// Marshal 未设置 cbor tag 时使用 json tag
+func (c *cborMarshaler) Marshal(v interface{}) ([]byte, error) {
+	return cbor.Marshal(v)
+}
+
+// Unmarshal .
+func (c *cborMarshaler) Unmarshal(data []byte, v interface{}) error {
+	return cbor.Unmarshal(data, v)
+}
+
+// RawMessage 转换为 json 格式, 用于日志输出
+func (c *cborMarshaler) RawMessage(data []byte) string {
+	var v interface{}
+	if err := raw.Unmarshal(data, &v); err != nil {
+		return fmt.Sprintf("[Cbor] %x", data)
+	}
+
+	var text []byte
+	var err error
+	if c.Indent {
+		text, err = json.MarshalIndent(v, "", "  ")
+	} else {
+		text, err = json.Marshal(v)
+	}
+	if err != nil {
+		return fmt.Sprintf("[Cbor] %x", data)
+	}
+	return string(text)
+}
+
+// ContentType .
+func (c *cborMarshaler) ContentType() content.Type {
+	return content.Cbor
+}
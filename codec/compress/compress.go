@@ -0,0 +1,186 @@
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+
+	"github.com/charlesbases/library/codec"
+	"github.com/charlesbases/library/content"
+)
+
+// magic 压缩数据的头部, 之后的一个字节为 Algorithm。没有该头部的数据视为未压缩
+var magic = []byte{0x00, 'C', 'Z'}
+
+var (
+	// ErrInvalidAlgorithm .
+	ErrInvalidAlgorithm = errors.New("compress: invalid algorithm")
+
+	// encoder zstd 编码器, 可并发使用
+	encoder, _ = zstd.NewWriter(nil)
+	// decoder zstd 解码器, 可并发使用
+	decoder, _ = zstd.NewReader(nil)
+)
+
+// Algorithm 压缩算法
+type Algorithm byte
+
+const (
+	// Gzip .
+	Gzip Algorithm = iota + 1
+	// Zstd .
+	Zstd
+	// Snappy .
+	Snappy
+)
+
+// encodings Algorithm 对应的编码名称
+var encodings = map[Algorithm]string{
+	Gzip:   "gzip",
+	Zstd:   "zstd",
+	Snappy: "snappy",
+}
+
+func init() {
+	// 解压时按数据头部识别压缩算法, 各编码名称使用相同的解码方式
+	for algorithm := range encodings {
+		algorithm := algorithm
+		codec.RegisterEncoding(encodings[algorithm], func(m codec.Marshaler) codec.Marshaler {
+			return NewMarshaler(m, func(o *Options) {
+				o.Algorithm = algorithm
+			})
+		})
+	}
+}
+
+// Options .
+type Options struct {
+	// Algorithm 压缩算法, 默认为 Gzip
+	Algorithm Algorithm
+	// MinSize 编码后小于 MinSize 字节的数据不压缩
+	MinSize int
+}
+
+// compressMarshaler 压缩 Marshaler 编码后的数据
+type compressMarshaler struct {
+	codec.Marshaler
+
+	opts *Options
+}
+
+// NewMarshaler 包装 'm', 编码后压缩数据。解码时兼容未压缩的数据
+//
+//	compress.NewMarshaler(json.Marshaler, func(o *compress.Options) { o.Algorithm = compress.Zstd })
+func NewMarshaler(m codec.Marshaler, opts ...func(o *Options)) codec.Marshaler {
+	var o = &Options{Algorithm: Gzip}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return &compressMarshaler{Marshaler: m, opts: o}
+}
+
+// Marshal .
+func (c *compressMarshaler) Marshal(v interface{}) ([]byte, error) {
+	data, err := c.Marshaler.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < c.opts.MinSize {
+		return data, nil
+	}
+
+	return compress(c.opts.Algorithm, data)
+}
+
+// Unmarshal .
+func (c *compressMarshaler) Unmarshal(data []byte, v interface{}) error {
+	data, err := decompress(data)
+	if err != nil {
+		return err
+	}
+	return c.Marshaler.Unmarshal(data, v)
+}
+
+// RawMessage .
+func (c *compressMarshaler) RawMessage(data []byte) string {
+	data, err := decompress(data)
+	if err != nil {
+		return "[Compressed]"
+	}
+	return c.Marshaler.RawMessage(data)
+}
+
+// ContentType 与被包装的 Marshaler 一致, 压缩算法见 ContentEncoding
+func (c *compressMarshaler) ContentType() content.Type {
+	return c.Marshaler.ContentType()
+}
+
+// ContentEncoding 压缩算法的编码名称: gzip, zstd, snappy
+func (c *compressMarshaler) ContentEncoding() string {
+	return encodings[c.opts.Algorithm]
+}
+
+// Unwrap .
+func (c *compressMarshaler) Unwrap() codec.Marshaler {
+	return c.Marshaler
+}
+
+// Envelope .
+func (c *compressMarshaler) Envelope() bool {
+	return codec.Envelope(c.Marshaler)
+}
+
+// compress .
+func compress(algorithm Algorithm, data []byte) ([]byte, error) {
+	var buff = bytes.NewBuffer(make([]byte, 0, len(magic)+1+len(data)/2))
+	buff.Write(magic)
+	buff.WriteByte(byte(algorithm))
+
+	switch algorithm {
+	case Gzip:
+		w := gzip.NewWriter(buff)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buff.Bytes(), nil
+	case Zstd:
+		return encoder.EncodeAll(data, buff.Bytes()), nil
+	case Snappy:
+		return append(buff.Bytes(), snappy.Encode(nil, data)...), nil
+	default:
+		return nil, ErrInvalidAlgorithm
+	}
+}
+
+// decompress 没有 magic 头部时原样返回
+func decompress(data []byte) ([]byte, error) {
+	if len(data) <= len(magic) || !bytes.HasPrefix(data, magic) {
+		return data, nil
+	}
+
+	var body = data[len(magic)+1:]
+	switch Algorithm(data[len(magic)]) {
+	case Gzip:
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	case Zstd:
+		return decoder.DecodeAll(body, nil)
+	case Snappy:
+		return snappy.Decode(nil, body)
+	default:
+		return nil, ErrInvalidAlgorithm
+	}
+}
@@ -0,0 +1,43 @@
+package compress
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/charlesbases/library/codec/json"
+)
+
+func TestCompress(t *testing.T) {
+	var v = map[string]string{"text": strings.Repeat("hello ", 100)}
+
+	for _, algorithm := range []Algorithm{Gzip, Zstd, Snappy} {
+		m := NewMarshaler(json.Marshaler, func(o *Options) {
+			o.Algorithm = algorithm
+		})
+
+		data, err := m.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) >= len(v["text"]) {
+			t.Fatalf("algorithm %d: not compressed: %d", algorithm, len(data))
+		}
+
+		var out map[string]string
+		if err := m.Unmarshal(data, &out); err != nil {
+			t.Fatal(err)
+		}
+		if out["text"] != v["text"] {
+			t.Fatalf("algorithm %d: unexpected value", algorithm)
+		}
+	}
+
+	// 未压缩的数据
+	var out map[string]string
+	if err := NewMarshaler(json.Marshaler).Unmarshal([]byte(`{"text":"hello"}`), &out); err != nil {
+		t.Fatal(err)
+	}
+	if out["text"] != "hello" {
+		t.Fatalf("unexpected value: %v", out)
+	}
+}
@@ -0,0 +1,260 @@
+package encrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	"github.com/charlesbases/library/codec"
+	"github.com/charlesbases/library/content"
+)
+
+// magic 加密数据的头部
+var magic = []byte{0x00, 'E', 'G'}
+
+// version 数据格式版本
+const version = 1
+
+// dataKeySize 每条数据独立生成的 AES-256 密钥长度
+const dataKeySize = 32
+
+// Encoding 加密数据的编码名称, 见 codec.RegisterEncoding
+const Encoding = "aes-gcm"
+
+var (
+	// ErrInvalidKey .
+	ErrInvalidKey = errors.New("encrypt: invalid key")
+	// ErrUnknownKey 数据使用的 key id 不在 Options.Keys 中
+	ErrUnknownKey = errors.New("encrypt: unknown key id")
+	// ErrNotEncrypted 数据未加密
+	ErrNotEncrypted = errors.New("encrypt: data is not encrypted")
+	// ErrInvalidData .
+	ErrInvalidData = errors.New("encrypt: invalid data")
+)
+
+// Options .
+type Options struct {
+	// Keys key id 对应的主密钥, 长度为 16、24 或 32 字节。轮换后旧的密钥需保留, 用于解密已有数据
+	Keys map[string][]byte
+	// KeyID 加密使用的 key id
+	KeyID string
+	// Plaintext 允许解码未加密的数据, 用于已有数据的迁移
+	Plaintext bool
+}
+
+// encryptMarshaler AES-GCM 信封加密 Marshaler 编码后的数据。
+// 每条数据使用随机生成的数据密钥加密, 数据密钥由 KeyID 对应的主密钥加密后与数据一同保存:
+//
+//	magic | version | len(key id) | key id | nonce | 加密的数据密钥 | nonce | 加密的数据
+type encryptMarshaler struct {
+	codec.Marshaler
+
+	opts *Options
+	keys map[string]cipher.AEAD
+}
+
+// NewMarshaler 包装 'm', 编码后加密数据
+//
+//	encrypt.NewMarshaler(json.Marshaler, func(o *encrypt.Options) {
+//		o.Keys = map[string][]byte{"2023": key2023, "2024": key2024}
+//		o.KeyID = "2024"
+//	})
+func NewMarshaler(m codec.Marshaler, opts ...func(o *Options)) (codec.Marshaler, error) {
+	var o = new(Options)
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	var c = &encryptMarshaler{Marshaler: m, opts: o, keys: make(map[string]cipher.AEAD, len(o.Keys))}
+	for id, key := range o.Keys {
+		if len(id) == 0 || len(id) > 255 {
+			return nil, errors.Wrapf(ErrInvalidKey, `key id "%s"`, id)
+		}
+
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, errors.Wrapf(ErrInvalidKey, `key id "%s": %v`, id, err)
+		}
+		c.keys[id] = aead
+	}
+
+	if _, found := c.keys[o.KeyID]; !found {
+		return nil, errors.Wrapf(ErrUnknownKey, `key id "%s"`, o.KeyID)
+	}
+	return c, nil
+}
+
+// Register 以 Encoding 注册解密使用的密钥。订阅方注册后, 可按消息头解码加密的消息, 无需为订阅单独设置 codec
+func Register(opts ...func(o *Options)) error {
+	m, err := NewMarshaler(nil, opts...)
+	if err != nil {
+		return err
+	}
+
+	var base = m.(*encryptMarshaler)
+	codec.RegisterEncoding(Encoding, func(m codec.Marshaler) codec.Marshaler {
+		var c = *base
+		c.Marshaler = m
+		return &c
+	})
+	return nil
+}
+
+// Marshal .
+func (c *encryptMarshaler) Marshal(v interface{}) ([]byte, error) {
+	data, err := c.Marshaler.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return c.seal(data)
+}
+
+// Unmarshal .
+func (c *encryptMarshaler) Unmarshal(data []byte, v interface{}) error {
+	if !bytes.HasPrefix(data, magic) {
+		if !c.opts.Plaintext {
+			return ErrNotEncrypted
+		}
+		return c.Marshaler.Unmarshal(data, v)
+	}
+
+	data, err := c.open(data)
+	if err != nil {
+		return err
+	}
+	return c.Marshaler.Unmarshal(data, v)
+}
+
+// RawMessage 不输出解密后的数据
+func (c *encryptMarshaler) RawMessage(data []byte) string {
+	if id, _, err := parseHeader(data); err == nil {
+		return fmt.Sprintf("[Encrypted] key id: %s", id)
+	}
+	return "[Encrypted]"
+}
+
+// ContentType 与被包装的 Marshaler 一致, 加密见 ContentEncoding
+func (c *encryptMarshaler) ContentType() content.Type {
+	return c.Marshaler.ContentType()
+}
+
+// ContentEncoding .
+func (c *encryptMarshaler) ContentEncoding() string {
+	return Encoding
+}
+
+// Unwrap .
+func (c *encryptMarshaler) Unwrap() codec.Marshaler {
+	return c.Marshaler
+}
+
+// Envelope .
+func (c *encryptMarshaler) Envelope() bool {
+	return codec.Envelope(c.Marshaler)
+}
+
+// seal .
+func (c *encryptMarshaler) seal(data []byte) ([]byte, error) {
+	var dataKey = make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var header = make([]byte, 0, len(magic)+2+len(c.opts.KeyID))
+	header = append(header, magic...)
+	header = append(header, version, byte(len(c.opts.KeyID)))
+	header = append(header, c.opts.KeyID...)
+
+	// header 作为附加数据, 防止 key id 被篡改
+	out, err := sealWith(c.keys[c.opts.KeyID], header, dataKey, header)
+	if err != nil {
+		return nil, err
+	}
+	return sealWith(aead, out, data, header)
+}
+
+// open .
+func (c *encryptMarshaler) open(data []byte) ([]byte, error) {
+	id, body, err := parseHeader(data)
+	if err != nil {
+		return nil, err
+	}
+
+	kek, found := c.keys[id]
+	if !found {
+		return nil, errors.Wrapf(ErrUnknownKey, `key id "%s"`, id)
+	}
+
+	var header = data[:len(data)-len(body)]
+
+	dataKey, body, err := openWith(kek, body, header, kek.NonceSize()+dataKeySize+kek.Overhead())
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	plain, _, err := openWith(aead, body, header, len(body))
+	return plain, err
+}
+
+// parseHeader 返回 key id 与 header 之后的数据
+func parseHeader(data []byte) (string, []byte, error) {
+	if !bytes.HasPrefix(data, magic) || len(data) < len(magic)+2 {
+		return "", nil, ErrInvalidData
+	}
+	if data[len(magic)] != version {
+		return "", nil, errors.Wrapf(ErrInvalidData, "version %d", data[len(magic)])
+	}
+
+	var size = int(data[len(magic)+1])
+	var body = data[len(magic)+2:]
+	if len(body) < size {
+		return "", nil, ErrInvalidData
+	}
+	return string(body[:size]), body[size:], nil
+}
+
+// newAEAD .
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealWith 加密 plain, 将 nonce 与密文追加至 dst
+func sealWith(aead cipher.AEAD, dst []byte, plain []byte, additional []byte) ([]byte, error) {
+	var nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	dst = append(dst, nonce...)
+	return aead.Seal(dst, nonce, plain, additional), nil
+}
+
+// openWith 解密 data 中前 size 个字节(nonce 与密文), 返回明文与剩余数据
+func openWith(aead cipher.AEAD, data []byte, additional []byte, size int) ([]byte, []byte, error) {
+	if len(data) < size || size < aead.NonceSize()+aead.Overhead() {
+		return nil, nil, ErrInvalidData
+	}
+
+	var nonce, sealed = data[:aead.NonceSize()], data[aead.NonceSize():size]
+	plain, err := aead.Open(nil, nonce, sealed, additional)
+	if err != nil {
+		return nil, nil, errors.Wrap(ErrInvalidData, err.Error())
+	}
+	return plain, data[size:], nil
+}
@@ -0,0 +1,60 @@
+package encrypt
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/charlesbases/library/codec/json"
+)
+
+func TestEncrypt(t *testing.T) {
+	var keys = map[string][]byte{
+		"v1": bytes.Repeat([]byte{1}, 32),
+		"v2": bytes.Repeat([]byte{2}, 32),
+	}
+
+	v1, err := NewMarshaler(json.Marshaler, func(o *Options) {
+		o.Keys = map[string][]byte{"v1": keys["v1"]}
+		o.KeyID = "v1"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := v1.Marshal("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("secret")) {
+		t.Fatal("data is not encrypted")
+	}
+
+	// 轮换后使用 v2 加密, 仍可解密 v1 加密的数据
+	v2, err := NewMarshaler(json.Marshaler, func(o *Options) {
+		o.Keys = keys
+		o.KeyID = "v2"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out string
+	if err := v2.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out != "secret" {
+		t.Fatalf("unexpected value: %s", out)
+	}
+
+	// 篡改 key id
+	data[len(magic)+2] = 'x'
+	if err := v2.Unmarshal(data, &out); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := v2.Unmarshal([]byte(`"secret"`), &out); !errors.Is(err, ErrNotEncrypted) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -10,6 +10,10 @@ import (
 // Marshaler default codec.Marshaler
 var Marshaler = NewMarshaler()
 
+func init() {
+	codec.Register(Marshaler)
+}
+
 type jsonMarshaler struct {
 	*codec.MarshalOptions
 }
@@ -0,0 +1,80 @@
+package msgpack
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/charlesbases/library/codec"
+	"github.com/charlesbases/library/content"
+)
+
+// tag 未设置 msgpack tag 时使用 json tag, 与 json 编码的字段名一致
+const tag = "json"
+
+// Marshaler default codec.Marshaler
+var Marshaler = NewMarshaler()
+
+func init() {
+	codec.Register(Marshaler)
+}
+
+type msgpackMarshaler struct {
+	*codec.MarshalOptions
+}
+
+// NewMarshaler .
+func NewMarshaler(opts ...func(o *codec.MarshalOptions)) codec.Marshaler {
+	var options = new(codec.MarshalOptions)
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	return &msgpackMarshaler{MarshalOptions: options}
+}
+
+// Marshal .
+func (c *msgpackMarshaler) Marshal(v interface{}) ([]byte, error) {
+	var buff = new(bytes.Buffer)
+
+	enc := msgpack.NewEncoder(buff)
+	enc.SetCustomStructTag(tag)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+// Unmarshal .
+func (c *msgpackMarshaler) Unmarshal(data []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag(tag)
+	return dec.Decode(v)
+}
+
+// RawMessage 转换为 json 格式, 用于日志输出
+func (c *msgpackMarshaler) RawMessage(data []byte) string {
+	var v interface{}
+	if err := c.Unmarshal(data, &v); err != nil {
+		return fmt.Sprintf("[MsgPack] %x", data)
+	}
+
+	var text []byte
+	var err error
+	if c.Indent {
+		text, err = json.MarshalIndent(v, "", "  ")
+	} else {
+		text, err = json.Marshal(v)
+	}
+	if err != nil {
+		return fmt.Sprintf("[MsgPack] %x", data)
+	}
+	return string(text)
+}
+
+// ContentType .
+func (c *msgpackMarshaler) ContentType() content.Type {
+	return content.MsgPack
+}
@@ -1,9 +1,19 @@
 package proto
 
 import (
-	"github.com/pkg/errors"
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
 
-	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/runtime/protoiface"
+	"google.golang.org/protobuf/runtime/protoimpl"
 
 	"github.com/charlesbases/library/codec"
 	"github.com/charlesbases/library/content"
@@ -17,11 +27,18 @@ const mess = "[ProtoMessage]"
 // Marshaler default codec.Marshaler
 var Marshaler = NewMarshaler()
 
+func init() {
+	codec.Register(Marshaler)
+}
+
 type protoMarshaler struct {
 	*codec.MarshalOptions
+
+	// typ RawMessage 解码使用的消息类型
+	typ protoreflect.MessageType
 }
 
-// NewMarshaler .
+// NewMarshaler RawMessage 按字段编号输出数据, 如 {"1":"hello","2":100}
 func NewMarshaler(opts ...func(o *codec.MarshalOptions)) codec.Marshaler {
 	var options = new(codec.MarshalOptions)
 	for _, opt := range opts {
@@ -31,26 +48,148 @@ func NewMarshaler(opts ...func(o *codec.MarshalOptions)) codec.Marshaler {
 	return &protoMarshaler{MarshalOptions: options}
 }
 
+// NewMessageMarshaler RawMessage 将数据解码为 'm' 的类型后, 以 protojson 格式输出
+func NewMessageMarshaler(m proto.Message, opts ...func(o *codec.MarshalOptions)) codec.Marshaler {
+	c := NewMarshaler(opts...).(*protoMarshaler)
+	c.typ = m.ProtoReflect().Type()
+	return c
+}
+
+// message 转换为 proto.Message。兼容 github.com/golang/protobuf 生成的旧版消息
+func message(v interface{}) (proto.Message, bool) {
+	switch m := v.(type) {
+	case proto.Message:
+		return m, true
+	case protoiface.MessageV1:
+		return protoimpl.X.ProtoMessageV2Of(m), true
+	default:
+		return nil, false
+	}
+}
+
 // Marshal .
 func (*protoMarshaler) Marshal(v interface{}) ([]byte, error) {
-	if pv, ok := v.(proto.Message); ok {
-		return proto.Marshal(pv)
-	} else {
-		return nil, ErrInvalidType
+	if pm, ok := message(v); ok {
+		return proto.Marshal(pm)
 	}
+	return nil, ErrInvalidType
 }
 
-// Unmarshal .
+// Unmarshal 'v' 不是 proto.Message 或为 nil 时返回 ErrInvalidType
 func (*protoMarshaler) Unmarshal(data []byte, v interface{}) error {
-	return proto.Unmarshal(data, v.(proto.Message))
+	if pm, ok := message(v); ok && pm.ProtoReflect().IsValid() {
+		return proto.Unmarshal(data, pm)
+	}
+	return ErrInvalidType
 }
 
 // RawMessage .
 func (c *protoMarshaler) RawMessage(data []byte) string {
-	return mess
+	if c.typ != nil {
+		m := c.typ.New().Interface()
+		if err := proto.Unmarshal(data, m); err != nil {
+			return mess
+		}
+
+		var o = protojson.MarshalOptions{}
+		if c.Indent {
+			o.Indent = "  "
+		}
+		text, err := o.Marshal(m)
+		if err != nil {
+			return mess
+		}
+		return string(text)
+	}
+
+	fields, ok := raw(data)
+	if !ok {
+		return mess
+	}
+
+	var text []byte
+	var err error
+	if c.Indent {
+		text, err = json.MarshalIndent(fields, "", "  ")
+	} else {
+		text, err = json.Marshal(fields)
+	}
+	if err != nil {
+		return mess
+	}
+	return string(text)
+}
+
+// Envelope 只能编码 proto.Message
+func (c *protoMarshaler) Envelope() bool {
+	return false
 }
 
 // ContentType .
 func (c *protoMarshaler) ContentType() content.Type {
 	return content.Proto
 }
+
+// raw 按字段编号解析数据, 同 protoc --decode_raw。重复的字段合并为数组
+func raw(data []byte) (map[string]interface{}, bool) {
+	var fields = make(map[string]interface{})
+	for len(data) != 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return nil, false
+		}
+		data = data[n:]
+
+		var v interface{}
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(data)
+		case protowire.Fixed32Type:
+			v, n = protowire.ConsumeFixed32(data)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(data)
+		case protowire.BytesType:
+			var b []byte
+			b, n = protowire.ConsumeBytes(data)
+			v = rawBytes(b)
+		default:
+			return nil, false
+		}
+		if n < 0 {
+			return nil, false
+		}
+		data = data[n:]
+
+		var key = strconv.Itoa(int(num))
+		switch exist := fields[key].(type) {
+		case nil:
+			fields[key] = v
+		case []interface{}:
+			fields[key] = append(exist, v)
+		default:
+			fields[key] = []interface{}{exist, v}
+		}
+	}
+	return fields, true
+}
+
+// rawBytes 可读的字符串原样输出; 否则尝试按嵌套消息解析, 失败时输出 base64
+func rawBytes(b []byte) interface{} {
+	if utf8.Valid(b) && printable(string(b)) {
+		return string(b)
+	}
+	if fields, ok := raw(b); ok && len(fields) != 0 {
+		return fields
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// printable .
+func printable(s string) bool {
+	for _, r := range s {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
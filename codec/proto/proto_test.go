@@ -0,0 +1,45 @@
+package proto
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestUnmarshal(t *testing.T) {
+	data, err := Marshaler.Marshal(wrapperspb.String("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var v = new(wrapperspb.StringValue)
+	if err := Marshaler.Unmarshal(data, v); err != nil {
+		t.Fatal(err)
+	}
+	if v.GetValue() != "hello" {
+		t.Fatalf("unexpected value: %s", v.GetValue())
+	}
+
+	var s string
+	if err := Marshaler.Unmarshal(data, &s); !errors.Is(err, ErrInvalidType) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := Marshaler.Unmarshal(data, (*wrapperspb.StringValue)(nil)); !errors.Is(err, ErrInvalidType) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestRawMessage(t *testing.T) {
+	data, err := Marshaler.Marshal(wrapperspb.String("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if raw := Marshaler.RawMessage(data); raw != `{"1":"hello"}` {
+		t.Fatalf("unexpected raw message: %s", raw)
+	}
+	if raw := NewMessageMarshaler(new(wrapperspb.StringValue)).RawMessage(data); raw != `"hello"` {
+		t.Fatalf("unexpected raw message: %s", raw)
+	}
+}
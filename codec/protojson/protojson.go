@@ -0,0 +1,72 @@
+package protojson
+
+import (
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/charlesbases/library/codec"
+	"github.com/charlesbases/library/content"
+)
+
+// ErrInvalidType .
+var ErrInvalidType = errors.New("protojson: not implemented")
+
+// Marshaler default codec.Marshaler
+var Marshaler = NewMarshaler()
+
+func init() {
+	codec.Register(Marshaler)
+}
+
+type protojsonMarshaler struct {
+	*codec.MarshalOptions
+}
+
+// NewMarshaler 按 protojson 规则编码 proto.Message, 如字段名使用 lowerCamelCase、int64 编码为字符串
+func NewMarshaler(opts ...func(o *codec.MarshalOptions)) codec.Marshaler {
+	var options = new(codec.MarshalOptions)
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	return &protojsonMarshaler{MarshalOptions: options}
+}
+
+// Marshal .
+func (c *protojsonMarshaler) Marshal(v interface{}) ([]byte, error) {
+	pm, ok := v.(proto.Message)
+	if !ok {
+		return nil, ErrInvalidType
+	}
+
+	var o = protojson.MarshalOptions{}
+	if c.Indent {
+		o.Indent = "  "
+	}
+	return o.Marshal(pm)
+}
+
+// Unmarshal 忽略未知字段
+func (c *protojsonMarshaler) Unmarshal(data []byte, v interface{}) error {
+	pm, ok := v.(proto.Message)
+	if !ok || !pm.ProtoReflect().IsValid() {
+		return ErrInvalidType
+	}
+	return protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(data, pm)
+}
+
+// RawMessage .
+func (c *protojsonMarshaler) RawMessage(data []byte) string {
+	return string(data)
+}
+
+// Envelope 只能编码 proto.Message
+func (c *protojsonMarshaler) Envelope() bool {
+	return false
+}
+
+// ContentType .
+func (c *protojsonMarshaler) ContentType() content.Type {
+	return content.ProtoJson
+}
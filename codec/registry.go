@@ -0,0 +1,101 @@
+package codec
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/charlesbases/library/content"
+)
+
+// registry content.Type 对应的 Marshaler
+var registry = struct {
+	sync.RWMutex
+	marshalers map[content.Type]Marshaler
+}{marshalers: make(map[content.Type]Marshaler)}
+
+// Register 注册 Marshaler, 相同 content.Type 的 Marshaler 会被覆盖。
+// codec 子包在 init 中注册默认的 Marshaler
+func Register(m Marshaler) {
+	registry.Lock()
+	registry.marshalers[m.ContentType()] = m
+	registry.Unlock()
+}
+
+// Lookup 获取 content.Type 对应的 Marshaler
+func Lookup(t content.Type) (Marshaler, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	m, found := registry.marshalers[t]
+	return m, found
+}
+
+// Enveloper Marshaler 只能编码特定类型(如 proto.Message)时实现, Envelope 返回 false。
+// 调用方不会将数据封装(如 broker.JsonMessage)后再编码
+type Enveloper interface {
+	Envelope() bool
+}
+
+// Envelope 数据是否可以封装后编码。未实现 Enveloper 时为 true
+func Envelope(m Marshaler) bool {
+	if e, ok := m.(Enveloper); ok {
+		return e.Envelope()
+	}
+	return true
+}
+
+// encodings 编码名称对应的包装方法
+var encodings = struct {
+	sync.RWMutex
+	wrappers map[string]func(m Marshaler) Marshaler
+}{wrappers: make(map[string]func(m Marshaler) Marshaler)}
+
+// Encoder Marshaler 包装其他 Marshaler, 并对编码后的数据再次编码(如压缩、加密)时实现
+type Encoder interface {
+	// ContentEncoding 编码名称, 见 RegisterEncoding
+	ContentEncoding() string
+	// Unwrap 被包装的 Marshaler
+	Unwrap() Marshaler
+}
+
+// RegisterEncoding 注册编码名称对应的包装方法, 解码方按数据的编码名称包装 Marshaler。
+// 相同名称的包装方法会被覆盖
+func RegisterEncoding(name string, wrap func(m Marshaler) Marshaler) {
+	encodings.Lock()
+	encodings.wrappers[name] = wrap
+	encodings.Unlock()
+}
+
+// ContentEncoding 'm' 依次使用的编码, 以 ", " 分隔, 与 HTTP Content-Encoding 一致。未包装时为空
+func ContentEncoding(m Marshaler) string {
+	var names []string
+	for {
+		e, ok := m.(Encoder)
+		if !ok {
+			break
+		}
+
+		names = append([]string{e.ContentEncoding()}, names...)
+		m = e.Unwrap()
+	}
+	return strings.Join(names, ", ")
+}
+
+// LookupEncoding 按 contentEncoding 依次包装 'm'。存在未注册的编码时返回 false
+func LookupEncoding(m Marshaler, contentEncoding string) (Marshaler, bool) {
+	if len(contentEncoding) == 0 {
+		return m, true
+	}
+
+	encodings.RLock()
+	defer encodings.RUnlock()
+
+	for _, name := range strings.Split(contentEncoding, ",") {
+		wrap, found := encodings.wrappers[strings.TrimSpace(name)]
+		if !found {
+			return nil, false
+		}
+		m = wrap(m)
+	}
+	return m, true
+}
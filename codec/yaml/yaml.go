@@ -15,6 +15,10 @@ const defaultConfigurationFilePath = "config.yaml"
 // Marshaler default codec.Marshaler
 var Marshaler = NewMarshaler()
 
+func init() {
+	codec.Register(Marshaler)
+}
+
 type yamlMarshaler struct {
 	*codec.DecodeOptions
 	*codec.MarshalOptions
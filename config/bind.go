@@ -0,0 +1,236 @@
+package config
+
+import (
+	"encoding"
+	"os"
+	"reflect"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	yamlUnmarshaler = reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
+	textUnmarshaler = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// field 结构体中可配置的字段
+type field struct {
+	index int
+	key   string
+	tag   reflect.StructTag
+	typ   reflect.Type
+}
+
+// fields 带有 yaml tag 的导出字段
+func fields(typ reflect.Type) []field {
+	var out = make([]field, 0, typ.NumField())
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		key, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		switch key {
+		case "-":
+			continue
+		case "":
+			key = strings.ToLower(f.Name)
+		}
+		out = append(out, field{index: i, key: key, tag: f.Tag, typ: f.Type})
+	}
+	return out
+}
+
+// nested 字段是否按结构体逐项加载
+func nested(typ reflect.Type) bool {
+	if typ.Kind() != reflect.Struct {
+		return false
+	}
+	ptr := reflect.PointerTo(typ)
+	return !ptr.Implements(yamlUnmarshaler) && !ptr.Implements(textUnmarshaler)
+}
+
+// join .
+func join(path string, key string) string {
+	if len(path) == 0 {
+		return key
+	}
+	return path + "." + key
+}
+
+// bind 将 tree 加载至 rv。tree 中不存在的字段使用 default tag
+func bind(tree *yaml.Node, rv reflect.Value, path string) error {
+	for _, f := range fields(rv.Type()) {
+		var fv = rv.Field(f.index)
+		var key = join(path, f.key)
+
+		node := lookup(tree, f.key)
+		if node != nil && node.ShortTag() == "!!null" {
+			node = nil
+		}
+
+		if nested(f.typ) {
+			if node != nil && node.Kind != yaml.MappingNode {
+				return errors.Errorf(`[config]: '%s': must be a mapping`, key)
+			}
+			if err := bind(node, fv, key); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if node != nil {
+			if err := node.Decode(fv.Addr().Interface()); err != nil {
+				return errors.Errorf(`[config]: '%s': %v`, key, err)
+			}
+			continue
+		}
+
+		if def, found := f.tag.Lookup("default"); found {
+			if err := yaml.Unmarshal([]byte(def), fv.Addr().Interface()); err != nil {
+				return errors.Errorf(`[config]: '%s': invalid default of "%s": %v`, key, def, err)
+			}
+		}
+	}
+	return nil
+}
+
+// envName spec.plugins.redis.accessKey -> APP_SPEC_PLUGINS_REDIS_ACCESS_KEY
+func envName(prefix string, path string) string {
+	var b strings.Builder
+	if len(prefix) != 0 {
+		b.WriteString(strings.ToUpper(prefix))
+		b.WriteByte('_')
+	}
+
+	var prev rune
+	for _, r := range path {
+		switch {
+		case r == '.' || r == '-':
+			b.WriteByte('_')
+		case unicode.IsUpper(r) && unicode.IsLower(prev):
+			b.WriteByte('_')
+			b.WriteRune(r)
+		default:
+			b.WriteRune(unicode.ToUpper(r))
+		}
+		prev = r
+	}
+	return b.String()
+}
+
+// environ 使用环境变量覆盖 tree 中对应的配置项
+func environ(tree *yaml.Node, typ reflect.Type, prefix string) error {
+	return walkEnv(tree, typ, prefix, "")
+}
+
+// walkEnv .
+func walkEnv(tree *yaml.Node, typ reflect.Type, prefix string, path string) error {
+	for _, f := range fields(typ) {
+		var key = join(path, f.key)
+
+		if nested(f.typ) {
+			sub := lookup(tree, f.key)
+			if sub == nil || sub.Kind != yaml.MappingNode {
+				sub = &yaml.Node{Kind: yaml.MappingNode}
+			}
+			if err := walkEnv(sub, f.typ, prefix, key); err != nil {
+				return err
+			}
+			if len(sub.Content) != 0 {
+				set(tree, f.key, sub)
+			}
+			continue
+		}
+
+		val, found := os.LookupEnv(envName(prefix, key))
+		if !found {
+			continue
+		}
+
+		node, err := envNode(val, f.typ)
+		if err != nil {
+			return errors.Errorf(`[config]: '%s': invalid environment variable %s: %v`, key, envName(prefix, key), err)
+		}
+		set(tree, f.key, node)
+	}
+	return nil
+}
+
+// envNode 环境变量的值。slice 可以使用 ',' 分隔, map 与 struct 使用 yaml 格式
+func envNode(val string, typ reflect.Type) (*yaml.Node, error) {
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+
+	switch typ.Kind() {
+	case reflect.Slice, reflect.Array:
+		if !strings.HasPrefix(strings.TrimSpace(val), "[") {
+			var seq = &yaml.Node{Kind: yaml.SequenceNode}
+			for _, item := range strings.Split(val, ",") {
+				seq.Content = append(seq.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: strings.TrimSpace(item)})
+			}
+			return seq, nil
+		}
+		fallthrough
+	case reflect.Map, reflect.Struct, reflect.Interface:
+		var doc yaml.Node
+		if err := yaml.Unmarshal([]byte(val), &doc); err != nil {
+			return nil, err
+		}
+		if len(doc.Content) == 0 {
+			return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null"}, nil
+		}
+		return doc.Content[0], nil
+	default:
+		// 按字段类型解析, 字符串保持原样
+		return &yaml.Node{Kind: yaml.ScalarNode, Value: val}, nil
+	}
+}
+
+// validate 校验 `validate:"required"` 的字段
+func validate(rv reflect.Value, path string) error {
+	if disabled(rv) {
+		return nil
+	}
+
+	for _, f := range fields(rv.Type()) {
+		var fv = rv.Field(f.index)
+		var key = join(path, f.key)
+
+		if required(f.tag) && fv.IsZero() {
+			return errors.Errorf(`[config]: '%s' is required`, key)
+		}
+
+		if nested(f.typ) {
+			if err := validate(fv, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// required .
+func required(tag reflect.StructTag) bool {
+	for _, rule := range strings.Split(tag.Get("validate"), ",") {
+		if strings.TrimSpace(rule) == "required" {
+			return true
+		}
+	}
+	return false
+}
+
+// disabled 结构体包含值为 false 的 Enabled(或 Enable) 字段
+func disabled(rv reflect.Value) bool {
+	for _, name := range []string{"Enabled", "Enable"} {
+		if f := rv.FieldByName(name); f.IsValid() && f.Kind() == reflect.Bool {
+			return !f.Bool()
+		}
+	}
+	return false
+}
@@ -0,0 +1,174 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// defaultFileName 默认配置文件路径
+	defaultFileName = "config.yaml"
+	// defaultEnvPrefix 默认环境变量前缀
+	defaultEnvPrefix = "APP"
+)
+
+// reference ${VAR} 或 ${VAR:-default}
+var reference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+
+// Options .
+type Options struct {
+	// FileName 基础配置文件. default: config.yaml
+	FileName string
+	// Profile 配置环境。如 "prod" 时, 使用 config.prod.yaml 覆盖基础配置。
+	// 为空时使用环境变量 <EnvPrefix>_PROFILE
+	Profile string
+	// EnvPrefix 环境变量前缀。如 APP_SPEC_PLUGINS_REDIS_PASSWORD 覆盖 'spec.plugins.redis.password'。default: APP
+	EnvPrefix string
+}
+
+// Load 按以下顺序加载配置至 'v', 后者覆盖前者:
+//
+//  1. 字段的 `default:"..."` tag
+//  2. 基础配置文件
+//  3. profile 配置文件
+//  4. 环境变量
+//
+// 配置文件中的 ${VAR} 与 ${VAR:-default} 替换为环境变量。
+// 加载后校验 `validate:"required"` 的字段; 结构体包含值为 false 的 Enabled 字段时, 不校验该结构体。
+// 错误信息中包含配置项的路径, 如 'spec.plugins.redis.timeout'
+func Load(v interface{}, opts ...func(o *Options)) error {
+	var o = &Options{FileName: defaultFileName, EnvPrefix: defaultEnvPrefix}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if len(o.Profile) == 0 {
+		o.Profile = os.Getenv(o.EnvPrefix + "_PROFILE")
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return errors.New("[config]: v must be a non-nil pointer to struct")
+	}
+
+	tree, err := read(o.FileName)
+	if err != nil {
+		return err
+	}
+
+	if len(o.Profile) != 0 {
+		profile, err := read(profileFileName(o.FileName, o.Profile))
+		if err != nil {
+			return err
+		}
+		merge(tree, profile)
+	}
+
+	if err := environ(tree, rv.Elem().Type(), o.EnvPrefix); err != nil {
+		return err
+	}
+
+	if err := bind(tree, rv.Elem(), ""); err != nil {
+		return err
+	}
+	return validate(rv.Elem(), "")
+}
+
+// profileFileName config.yaml -> config.prod.yaml
+func profileFileName(name string, profile string) string {
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + profile + ext
+}
+
+// read 读取配置文件, 替换其中的环境变量
+func read(name string) (*yaml.Node, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "[config]")
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, errors.Wrapf(err, "[config]: %s", name)
+	}
+
+	// 空文件
+	if len(doc.Content) == 0 {
+		return &yaml.Node{Kind: yaml.MappingNode}, nil
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, errors.Errorf("[config]: %s: must be a mapping", name)
+	}
+
+	expand(root)
+	return root, nil
+}
+
+// expand 替换 ${VAR}。未加引号的值按替换后的内容重新解析类型
+func expand(n *yaml.Node) {
+	if n.Kind != yaml.ScalarNode {
+		for _, c := range n.Content {
+			expand(c)
+		}
+		return
+	}
+
+	if !strings.Contains(n.Value, "${") {
+		return
+	}
+
+	n.Value = reference.ReplaceAllStringFunc(n.Value, func(s string) string {
+		m := reference.FindStringSubmatch(s)
+		if val, found := os.LookupEnv(m[1]); found {
+			return val
+		}
+		return m[2]
+	})
+	if n.Style == 0 {
+		n.Tag = ""
+	}
+}
+
+// lookup mapping 中 key 对应的值
+func lookup(m *yaml.Node, key string) *yaml.Node {
+	if m == nil || m.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// set 设置 mapping 中 key 对应的值
+func set(m *yaml.Node, key string, val *yaml.Node) {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			m.Content[i+1] = val
+			return
+		}
+	}
+	m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, val)
+}
+
+// merge 将 src 合并至 dst。mapping 递归合并, 其他类型的值直接覆盖
+func merge(dst *yaml.Node, src *yaml.Node) {
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		key, val := src.Content[i].Value, src.Content[i+1]
+
+		if exist := lookup(dst, key); exist != nil && exist.Kind == yaml.MappingNode && val.Kind == yaml.MappingNode {
+			merge(exist, val)
+			continue
+		}
+		set(dst, key, val)
+	}
+}
@@ -0,0 +1,95 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type testConfig struct {
+	Name string `yaml:"name" validate:"required"`
+	Port string `yaml:"port" default:":8080"`
+	Spec struct {
+		Redis struct {
+			Enabled  bool     `yaml:"enabled"`
+			Address  []string `yaml:"address" validate:"required"`
+			Password string   `yaml:"password"`
+			Timeout  int      `yaml:"timeout" default:"3"`
+		} `yaml:"redis"`
+		Storage struct {
+			Enabled   bool   `yaml:"enabled"`
+			AccessKey string `yaml:"accessKey" validate:"required"`
+		} `yaml:"storage"`
+	} `yaml:"spec"`
+}
+
+// write .
+func write(t *testing.T, dir string, name string, data string) string {
+	file := filepath.Join(dir, name)
+	if err := os.WriteFile(file, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+
+	file := write(t, dir, "config.yaml", `
+name: app
+spec:
+  redis:
+    enabled: true
+    address: ['127.0.0.1:6379']
+    password: ${TEST_REDIS_PASSWORD:-default}
+`)
+	write(t, dir, "config.prod.yaml", `
+spec:
+  redis:
+    timeout: ${TEST_REDIS_TIMEOUT}
+`)
+
+	t.Setenv("TEST_REDIS_TIMEOUT", "10")
+	t.Setenv("APP_SPEC_REDIS_ADDRESS", "10.0.0.1:6379,10.0.0.2:6379")
+
+	var conf = new(testConfig)
+	if err := Load(conf, func(o *Options) {
+		o.FileName = file
+		o.Profile = "prod"
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if conf.Name != "app" || conf.Port != ":8080" {
+		t.Fatalf("unexpected config: %+v", conf)
+	}
+
+	redis := conf.Spec.Redis
+	if redis.Password != "default" || redis.Timeout != 10 || strings.Join(redis.Address, ",") != "10.0.0.1:6379,10.0.0.2:6379" {
+		t.Fatalf("unexpected redis config: %+v", redis)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	for data, expected := range map[string]string{
+		"spec: {redis: {enabled: true}}":                              "'name' is required",
+		"name: app\nspec: {redis: {enabled: true}}":                   "'spec.redis.address' is required",
+		"name: app\nspec: {redis: {address: [a], timeout: x}}":        "'spec.redis.timeout'",
+		"name: app\nspec: {storage: {enabled: true, accessKey: ''}}":  "'spec.storage.accessKey' is required",
+		"name: app\nspec: {storage: {enabled: false, accessKey: ''}}": "",
+	} {
+		err := Load(new(testConfig), func(o *Options) {
+			o.FileName = write(t, dir, "config.yaml", data)
+		})
+
+		switch {
+		case len(expected) == 0 && err != nil:
+			t.Fatalf("%s: %v", data, err)
+		case len(expected) != 0 && (err == nil || !strings.Contains(err.Error(), expected)):
+			t.Fatalf("%s: unexpected error: %v", data, err)
+		}
+	}
+}
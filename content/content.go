@@ -23,17 +23,26 @@ const (
 	FromData
 	// Zip application/zip
 	Zip
+	// MsgPack application/msgpack
+	MsgPack
+	// Cbor application/cbor
+	Cbor
+	// ProtoJson application/protojson
+	ProtoJson
 )
 
 var contents = map[Type]string{
-	Zip:      "application/zip",
-	Yaml:     "application/yaml",
-	Text:     "application/text",
-	Json:     "application/json",
-	Bytes:    "application/bytes",
-	Proto:    "application/proto",
-	Stream:   "application/octet-stream",
-	FromData: "multiparty/from-data",
+	Zip:       "application/zip",
+	Yaml:      "application/yaml",
+	Text:      "application/text",
+	Json:      "application/json",
+	Bytes:     "application/bytes",
+	Proto:     "application/proto",
+	Stream:    "application/octet-stream",
+	FromData:  "multiparty/from-data",
+	MsgPack:   "application/msgpack",
+	Cbor:      "application/cbor",
+	ProtoJson: "application/protojson",
 }
 
 var reverse = map[string]Type{
@@ -45,6 +54,10 @@ var reverse = map[string]Type{
 	"application/proto":        Proto,
 	"application/octet-stream": Stream,
 	"multiparty/from-data":     FromData,
+	"application/msgpack":      MsgPack,
+	"application/x-msgpack":    MsgPack,
+	"application/cbor":         Cbor,
+	"application/protojson":    ProtoJson,
 }
 
 // String .
@@ -0,0 +1,62 @@
+package outbox
+
+import (
+	"time"
+
+	"github.com/charlesbases/library/broker"
+)
+
+var (
+	// defaultTable outbox 默认表名
+	defaultTable = "outbox_messages"
+	// defaultInterval 默认轮询间隔
+	defaultInterval = time.Second
+	// defaultBatchSize 每次轮询默认发布的最大消息数
+	defaultBatchSize = 100
+	// defaultMaxAttempts 默认最大发布次数
+	defaultMaxAttempts = 10
+	// defaultBackoff 默认重试间隔
+	defaultBackoff = broker.ExponentialBackoff(time.Second, time.Minute)
+	// defaultRetention 已发布消息的默认保留时间
+	defaultRetention = 7 * 24 * time.Hour
+	// defaultCleanupInterval 清理已发布消息的间隔
+	defaultCleanupInterval = time.Hour
+	// defaultTimeout 等待 broker 确认的默认超时时间
+	defaultTimeout = 3 * time.Second
+)
+
+// Options .
+type Options struct {
+	// Table outbox 表名。default: outbox_messages
+	Table string
+	// Interval 轮询间隔。default: 1s
+	Interval time.Duration
+	// BatchSize 每次轮询发布的最大消息数。default: 100
+	BatchSize int
+	// MaxAttempts 最大发布次数, 超过后消息标记为 StatusFailed, 不再发布。default: 10
+	MaxAttempts int
+	// Backoff 发布失败后的重试间隔。default: 1s 起, 指数增长, 最大 1m
+	Backoff broker.Backoff
+	// Retention 已发布消息的保留时间, 超时后删除。<= 0 时不清理。default: 7d
+	Retention time.Duration
+	// Timeout 等待 broker 确认的超时时间。default: 3s
+	Timeout time.Duration
+}
+
+// ParseOptions .
+func ParseOptions(opts ...func(o *Options)) *Options {
+	o := &Options{
+		Table:       defaultTable,
+		Interval:    defaultInterval,
+		BatchSize:   defaultBatchSize,
+		MaxAttempts: defaultMaxAttempts,
+		Backoff:     defaultBackoff,
+		Retention:   defaultRetention,
+		Timeout:     defaultTimeout,
+	}
+
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
@@ -0,0 +1,402 @@
+package outbox
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/charlesbases/logger"
+
+	"github.com/charlesbases/library/broker"
+	"github.com/charlesbases/library/codec/json"
+	"github.com/charlesbases/library/database"
+	"github.com/charlesbases/library/lifecycle"
+)
+
+// ErrOutboxNotReady outbox is not initialized
+var ErrOutboxNotReady = errors.New("outbox is not ready")
+
+// Status 消息状态
+type Status int8
+
+const (
+	// StatusPending 待发布
+	StatusPending Status = iota
+	// StatusSent 已发布
+	StatusSent
+	// StatusFailed 超过最大发布次数, 不再发布
+	StatusFailed
+)
+
+// Message outbox 消息
+type Message struct {
+	ID uint64 `gorm:"primaryKey;autoIncrement"`
+	// Topic .
+	Topic string `gorm:"size:255;not null"`
+	// Aggregate 聚合标识, 即 broker.PublishOptions.Key。相同 aggregate 的消息按写入顺序发布
+	Aggregate string `gorm:"size:255"`
+	// ContentType 消息格式
+	ContentType string `gorm:"size:64"`
+	// Header 消息头, json 编码
+	Header string `gorm:"type:text"`
+	// Body 已编码的消息
+	Body []byte
+	// Status 消息状态
+	Status Status `gorm:"index;not null;default:0"`
+	// Attempts 已发布次数
+	Attempts int `gorm:"not null;default:0"`
+	// LastError 最后一次发布失败的原因
+	LastError string `gorm:"type:text"`
+	// NextAt 下次发布时间
+	NextAt time.Time
+	// CreatedAt 写入时间
+	CreatedAt time.Time
+	// SentAt 发布时间
+	SentAt *time.Time `gorm:"index"`
+}
+
+// Outbox 事务消息。消息随业务数据在同一事务中写入 outbox 表, 由 relay 异步发布至 broker
+type Outbox struct {
+	id     string
+	db     *gorm.DB
+	client broker.Client
+	opts   *Options
+
+	notify  chan struct{}
+	started bool
+	start   sync.Once
+	closing chan struct{}
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// table .
+func (ob *Outbox) table(tx *gorm.DB) *gorm.DB {
+	return tx.Table(ob.opts.Table)
+}
+
+// Migrate 创建 outbox 表
+func (ob *Outbox) Migrate() error {
+	return errors.Wrapf(ob.table(ob.db).AutoMigrate(new(Message)), "[outbox]: migrate")
+}
+
+// Publish 在事务 tx 中写入消息。事务提交后, 消息由 relay 发布至 broker
+func (ob *Outbox) Publish(tx *gorm.DB, topic string, v interface{}, opts ...func(o *broker.PublishOptions)) error {
+	if err := broker.CheckSubject(topic); err != nil {
+		return errors.Wrapf(err, `[outbox]: publish["%s"]`, topic)
+	}
+
+	var o = broker.ParsePublishOptions(opts...)
+
+	data, err := broker.Marshal(ob.id, v, o.Codec)
+	if err != nil {
+		return errors.Wrapf(err, `[outbox]: publish["%s"]`, topic)
+	}
+
+	header, err := json.Marshaler.Marshal(broker.Inject(o.Context, o.Header))
+	if err != nil {
+		return errors.Wrapf(err, `[outbox]: publish["%s"]`, topic)
+	}
+
+	var now = time.Now()
+	if err := ob.table(tx).Create(
+		&Message{
+			Topic:       topic,
+			Aggregate:   o.Key,
+			ContentType: o.Codec.ContentType().String(),
+			Header:      string(header),
+			Body:        data,
+			Status:      StatusPending,
+			NextAt:      now,
+			CreatedAt:   now,
+		},
+	).Error; err != nil {
+		return errors.Wrapf(err, `[outbox]: publish["%s"]`, topic)
+	}
+
+	logger.CallerSkip(o.CallerSkip+1).Context(o.Context).Debugf(`[outbox]: publish["%s"]: %s`, topic, o.Codec.RawMessage(data))
+	return nil
+}
+
+// Transaction 执行事务, 提交成功后唤醒 relay 立即发布
+func (ob *Outbox) Transaction(fs ...func(tx *gorm.DB) error) error {
+	err := ob.db.Transaction(func(tx *gorm.DB) error {
+		for _, f := range fs {
+			if err := f(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		ob.Notify()
+	}
+	return err
+}
+
+// Notify 唤醒 relay 立即发布
+func (ob *Outbox) Notify() {
+	select {
+	case ob.notify <- struct{}{}:
+	default:
+	}
+}
+
+// send 发布消息, 等待 broker 确认
+func (ob *Outbox) send(m *Message) error {
+	var header = make(broker.Header)
+	if len(m.Header) != 0 {
+		if err := json.Marshaler.Unmarshal([]byte(m.Header), &header); err != nil {
+			return err
+		}
+	}
+
+	_, err := ob.client.PublishSync(
+		m.Topic, broker.Raw(m.Body), func(o *broker.PublishOptions) {
+			o.Context = broker.Extract(context.Background(), header)
+			o.Codec = broker.LookupCodec(m.ContentType)
+			o.Header = header
+			o.Timeout = ob.opts.Timeout
+		},
+	)
+	return err
+}
+
+// claim 在短事务中认领已到发布时间的消息, 认领期间其他 relay 不会读取这些消息。
+// 同一 aggregate 中存在更早的未到发布时间(或已被认领)的消息时, 不认领该 aggregate 的消息, 以保证发布顺序
+func (ob *Outbox) claim(now time.Time) (msgs []*Message, err error) {
+	err = ob.db.Transaction(func(tx *gorm.DB) error {
+		var table = ob.opts.Table
+
+		var earlier = tx.Session(&gorm.Session{NewDB: true}).
+			Table(table+" AS earlier").
+			Select("1").
+			Where("earlier.aggregate = "+table+".aggregate AND earlier.id < "+table+".id").
+			Where("earlier.status = ? AND earlier.next_at > ?", StatusPending, now)
+
+		if err := ob.table(tx).
+			Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("status = ? AND next_at <= ?", StatusPending, now).
+			Where("aggregate = ? OR NOT EXISTS (?)", "", earlier).
+			Order("id").
+			Limit(ob.opts.BatchSize).
+			Find(&msgs).Error; err != nil {
+			return err
+		}
+		if len(msgs) == 0 {
+			return nil
+		}
+
+		var ids = make([]uint64, 0, len(msgs))
+		for _, m := range msgs {
+			ids = append(ids, m.ID)
+		}
+
+		// 认领至全部消息等待确认超时, relay 异常退出时, 消息在认领过期后重新发布
+		return ob.table(tx).
+			Where("id IN ?", ids).
+			Update("next_at", now.Add(ob.opts.Timeout*time.Duration(len(msgs)))).Error
+	})
+	return msgs, err
+}
+
+// flush 按写入顺序发布已认领的消息, 发布在事务之外进行。more 表示可能仍有待发布的消息。
+// 同一 aggregate 的消息发布失败时, 本次不再发布该 aggregate 之后的消息, 并释放认领
+func (ob *Outbox) flush() (more bool, err error) {
+	var now = time.Now()
+
+	msgs, err := ob.claim(now)
+	if err != nil {
+		return false, err
+	}
+
+	var blocked = make(map[string]bool)
+	var released []uint64
+	for _, m := range msgs {
+		if len(m.Aggregate) != 0 && blocked[m.Aggregate] {
+			released = append(released, m.ID)
+			continue
+		}
+
+		var updates = map[string]interface{}{"attempts": m.Attempts + 1}
+		if err := ob.send(m); err != nil {
+			logger.Errorf(`[outbox]: relay["%s"]: id: %d: attempts: %d: %v`, m.Topic, m.ID, m.Attempts+1, err)
+
+			blocked[m.Aggregate] = true
+
+			updates["last_error"] = err.Error()
+			if m.Attempts+1 >= ob.opts.MaxAttempts {
+				updates["status"] = StatusFailed
+			} else {
+				updates["next_at"] = time.Now().Add(ob.opts.Backoff(m.Attempts + 1))
+			}
+		} else {
+			updates["status"] = StatusSent
+			updates["sent_at"] = time.Now()
+		}
+
+		if err := ob.table(ob.db).Where("id = ?", m.ID).Updates(updates).Error; err != nil {
+			return false, err
+		}
+	}
+
+	if len(released) != 0 {
+		if err := ob.table(ob.db).Where("id IN ?", released).Update("next_at", now).Error; err != nil {
+			return false, err
+		}
+	}
+	return len(msgs) == ob.opts.BatchSize, nil
+}
+
+// cleanup 删除超过保留时间的已发布消息
+func (ob *Outbox) cleanup() {
+	if ob.opts.Retention <= 0 {
+		return
+	}
+
+	if err := ob.table(ob.db).
+		Where("status = ? AND sent_at < ?", StatusSent, time.Now().Add(-ob.opts.Retention)).
+		Delete(new(Message)).Error; err != nil {
+		logger.Errorf(`[outbox]: cleanup: %v`, err)
+	}
+}
+
+// relay .
+func (ob *Outbox) relay() {
+	defer close(ob.closed)
+
+	t := time.NewTicker(ob.opts.Interval)
+	defer t.Stop()
+
+	c := time.NewTicker(defaultCleanupInterval)
+	defer c.Stop()
+
+	for {
+		select {
+		case <-ob.closing:
+			return
+		case <-c.C:
+			ob.cleanup()
+			continue
+		case <-t.C:
+		case <-ob.notify:
+		}
+
+		for {
+			more, err := ob.flush()
+			if err != nil {
+				logger.Errorf(`[outbox]: relay: %v`, err)
+			}
+			if err != nil || !more {
+				break
+			}
+
+			select {
+			case <-ob.closing:
+				return
+			default:
+			}
+		}
+	}
+}
+
+// Start 启动 relay。重复调用时只启动一次
+func (ob *Outbox) Start() {
+	ob.start.Do(func() {
+		logger.Debugf(`[outbox]: relay started`)
+
+		ob.started = true
+		go ob.relay()
+	})
+}
+
+// Stop 停止 relay, 等待正在发布的消息完成
+func (ob *Outbox) Stop() {
+	if !ob.started {
+		return
+	}
+
+	ob.once.Do(func() {
+		close(ob.closing)
+	})
+	<-ob.closed
+
+	logger.Debugf(`[outbox]: relay stopped`)
+}
+
+// Hook 以 lifecycle.Hook 运行 relay。启动时创建 outbox 表
+func (ob *Outbox) Hook() *lifecycle.Hook {
+	return &lifecycle.Hook{
+		Name: "outbox",
+		OnStart: func(ctx context.Context) error {
+			if err := ob.Migrate(); err != nil {
+				return err
+			}
+
+			ob.Start()
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			ob.Stop()
+			return nil
+		},
+	}
+}
+
+// New .
+func New(id string, db *gorm.DB, client broker.Client, opts ...func(o *Options)) (*Outbox, error) {
+	if db == nil {
+		return nil, database.ErrorDatabaseNil
+	}
+	if client == nil {
+		return nil, broker.ErrNotReady
+	}
+
+	return &Outbox{
+		id:      id,
+		db:      db,
+		client:  client,
+		opts:    ParseOptions(opts...),
+		notify:  make(chan struct{}, 1),
+		closing: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}, nil
+}
+
+// ob default outbox
+var ob *Outbox
+
+// Init init default outbox
+func Init(id string, db *gorm.DB, client broker.Client, opts ...func(o *Options)) error {
+	o, err := New(id, db, client, opts...)
+	if err != nil {
+		return err
+	}
+	ob = o
+	return nil
+}
+
+// Publish 使用默认 outbox 在事务 tx 中写入消息
+func Publish(tx *gorm.DB, topic string, v interface{}, opts ...func(o *broker.PublishOptions)) error {
+	if ob == nil {
+		return ErrOutboxNotReady
+	}
+	return ob.Publish(tx, topic, v, opts...)
+}
+
+// Transaction 使用默认 outbox 执行事务, 提交成功后唤醒 relay
+func Transaction(fs ...func(tx *gorm.DB) error) error {
+	if ob == nil {
+		return ErrOutboxNotReady
+	}
+	return ob.Transaction(fs...)
+}
+
+// Default .
+func Default() *Outbox {
+	return ob
+}
@@ -0,0 +1,78 @@
+package outbox
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/charlesbases/library/broker"
+	"github.com/charlesbases/library/broker/memory"
+	"github.com/charlesbases/library/database"
+	"github.com/charlesbases/library/database/orm"
+	"github.com/charlesbases/library/database/orm/driver"
+)
+
+// envPostgresDSN 测试使用的 postgres dsn, 未设置时跳过测试
+const envPostgresDSN = "OUTBOX_POSTGRES_DSN"
+
+func TestOutbox(t *testing.T) {
+	var dsn = os.Getenv(envPostgresDSN)
+	if len(dsn) == 0 {
+		t.Skipf("%s is not set", envPostgresDSN)
+	}
+
+	err := orm.Init(new(driver.Postgres), func(o *database.Options) {
+		o.Address = dsn
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := memory.NewClient("test.outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var topic = "outbox"
+
+	var received = make(chan string, 1)
+	c.Subscribe(topic, func(ctx context.Context, event broker.Event) error {
+		var v string
+		if err := event.Unmarshal(&v); err != nil {
+			return err
+		}
+		received <- v
+		return nil
+	})
+
+	if err := Init("test.outbox", orm.DB(), c); err != nil {
+		t.Fatal(err)
+	}
+
+	hook := Default().Hook()
+	if err := hook.OnStart(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer hook.OnStop(context.Background())
+
+	if err := Transaction(func(tx *gorm.DB) error {
+		return Publish(tx, topic, "hello", func(o *broker.PublishOptions) {
+			o.Key = "aggregate"
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case v := <-received:
+		if v != "hello" {
+			t.Fatalf("unexpected message: %s", v)
+		}
+	case <-time.NewTimer(3 * time.Second).C:
+		t.Fatal("relay timeout")
+	}
+}
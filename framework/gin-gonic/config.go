@@ -15,11 +15,15 @@ import (
 
 	"github.com/charlesbases/library/broker"
 	"github.com/charlesbases/library/broker/kafka"
+	"github.com/charlesbases/library/broker/memory"
 	"github.com/charlesbases/library/broker/nats"
-	"github.com/charlesbases/library/codec/yaml"
+	"github.com/charlesbases/library/broker/redisstream"
+	"github.com/charlesbases/library/broker/scheduler"
+	"github.com/charlesbases/library/config"
 	"github.com/charlesbases/library/database"
 	"github.com/charlesbases/library/database/orm"
 	"github.com/charlesbases/library/database/orm/driver"
+	"github.com/charlesbases/library/database/outbox"
 	"github.com/charlesbases/library/framework/gin-gonic/hfwctx"
 	"github.com/charlesbases/library/framework/gin-gonic/middlewares"
 	"github.com/charlesbases/library/framework/gin-gonic/middlewares/jwt"
@@ -36,7 +40,7 @@ import (
 // configuration .
 type configuration struct {
 	// Name server name
-	Name string `yaml:"name"`
+	Name string `yaml:"name" validate:"required"`
 	// Port http port
 	Port string `yaml:"port" default:":8080"`
 	// Spec spec
@@ -95,7 +99,7 @@ type webtoken struct {
 	// Enabled enabled
 	Enabled bool `yaml:"enabled"`
 	// Secret jwt secret
-	Secret string `yaml:"secret"`
+	Secret string `yaml:"secret" validate:"required"`
 	// Expire token 过期时间。单位：秒
 	Expire int `yaml:"expire"`
 	// Interceptor jwt 拦截器
@@ -112,6 +116,8 @@ type plugins struct {
 	Storage pluginStorage `yaml:"storage"`
 	// Database database
 	Database pluginDatabase `yaml:"database"`
+	// Outbox 事务消息。依赖 database 和 broker
+	Outbox pluginOutbox `yaml:"outbox"`
 }
 
 // pluginRedis .
@@ -119,9 +125,9 @@ type pluginRedis struct {
 	// Enabled enabled
 	Enabled bool `yaml:"enabled"`
 	// Type client or cluster
-	Type string `yaml:"type"`
+	Type string `yaml:"type" validate:"required"`
 	// Address address for redis
-	Address []string `yaml:"address"`
+	Address []string `yaml:"address" validate:"required"`
 	// Username username
 	Username string `yaml:"username"`
 	// Password password
@@ -136,14 +142,108 @@ type pluginRedis struct {
 type pluginBroker struct {
 	// Enabled enabled
 	Enabled bool `yaml:"enabled"`
-	// Type type of broker
-	Type string `yaml:"type"`
+	// Type type of broker. nats, kafka, redis or memory. redis 使用 spec.plugins.redis 的连接
+	Type string `yaml:"type" validate:"required"`
 	// Version kafka version
 	Version string `yaml:"version"`
-	// Address address
+	// Address address。多个地址以 ',' 分隔
 	Address string `yaml:"address"`
+	// Addrs 地址列表, 与 address 合并
+	Addrs []string `yaml:"addrs"`
+	// Username kafka: SASL 用户名; nats: user
+	Username string `yaml:"username"`
+	// Password kafka: SASL 密码; nats: password
+	Password string `yaml:"password"`
+	// SASLMechanism kafka SASL 认证方式: PLAIN, SCRAM-SHA-256, SCRAM-SHA-512
+	SASLMechanism string `yaml:"saslMechanism"`
+	// Credentials nats 凭证文件(.creds)
+	Credentials string `yaml:"credentials"`
+	// NKeySeed nats nkey seed 文件
+	NKeySeed string `yaml:"nkeySeed"`
+	// TLS tls
+	TLS pluginTLS `yaml:"tls"`
+	// Stream nats JetStream stream 配置
+	Stream pluginStream `yaml:"stream"`
 	// ReconnectWait default: 3s
 	ReconnectWait int `yaml:"reconnectWait" default:"3"`
+	// MaxReconnectWait 最大重连等待时间。重连间隔从 reconnectWait 开始指数增长。default: 60s
+	MaxReconnectWait int `yaml:"maxReconnectWait" default:"60"`
+	// Scheduler 启用延迟发布(PublishOptions.Delay)。延迟消息保存在 spec.plugins.redis 中
+	Scheduler bool `yaml:"scheduler"`
+}
+
+// options nats 与 kafka 的连接配置
+func (p *pluginBroker) options(o *broker.Options) {
+	o.Version = p.Version
+	o.Address = p.Address
+	o.Addrs = p.Addrs
+	o.Username = p.Username
+	o.Password = p.Password
+	o.SASLMechanism = p.SASLMechanism
+	o.Credentials = p.Credentials
+	o.NKeySeed = p.NKeySeed
+	o.ReconnectWait = time.Duration(p.ReconnectWait) * time.Second
+	if p.MaxReconnectWait > 0 {
+		o.MaxReconnectWait = time.Duration(p.MaxReconnectWait) * time.Second
+	}
+
+	if p.Stream.Enabled {
+		o.Stream = &broker.StreamOptions{
+			Name:      p.Stream.Name,
+			Subjects:  p.Stream.Subjects,
+			Retention: p.Stream.Retention,
+			MaxAge:    time.Duration(p.Stream.MaxAge) * time.Hour,
+			MaxBytes:  p.Stream.MaxBytes,
+			MaxMsgs:   p.Stream.MaxMsgs,
+			Replicas:  p.Stream.Replicas,
+			Storage:   p.Stream.Storage,
+		}
+	}
+
+	if p.TLS.Enabled {
+		o.TLS = &broker.TLSOptions{
+			CAFile:             p.TLS.CAFile,
+			CertFile:           p.TLS.CertFile,
+			KeyFile:            p.TLS.KeyFile,
+			InsecureSkipVerify: p.TLS.InsecureSkipVerify,
+		}
+	}
+}
+
+// pluginStream .
+type pluginStream struct {
+	// Enabled 使用该配置创建并更新 stream
+	Enabled bool `yaml:"enabled"`
+	// Name stream 名称。subjects 包含的 topic 共用该 stream
+	Name string `yaml:"name"`
+	// Subjects 支持通配符 '*' 与 '>'
+	Subjects []string `yaml:"subjects"`
+	// Retention limits, interest or workqueue. default: workqueue
+	Retention string `yaml:"retention"`
+	// MaxAge 消息保留时间。单位: 小时。< 0 时不限制。default: 168
+	MaxAge int `yaml:"maxAge"`
+	// MaxBytes stream 最大字节数
+	MaxBytes int64 `yaml:"maxBytes"`
+	// MaxMsgs stream 最大消息数
+	MaxMsgs int64 `yaml:"maxMsgs"`
+	// Replicas 副本数。default: 1
+	Replicas int `yaml:"replicas"`
+	// Storage file or memory. default: file
+	Storage string `yaml:"storage"`
+}
+
+// pluginTLS .
+type pluginTLS struct {
+	// Enabled enabled
+	Enabled bool `yaml:"enabled"`
+	// CAFile CA 证书。为空时使用系统根证书
+	CAFile string `yaml:"caFile"`
+	// CertFile 客户端证书
+	CertFile string `yaml:"certFile"`
+	// KeyFile 客户端私钥
+	KeyFile string `yaml:"keyFile"`
+	// InsecureSkipVerify 跳过服务端证书校验
+	InsecureSkipVerify bool `yaml:"insecureSkipVerify"`
 }
 
 // pluginStorage .
@@ -151,9 +251,9 @@ type pluginStorage struct {
 	// Enabled enabled
 	Enabled bool `yaml:"enabled"`
 	// Type storage.Type
-	Type string `yaml:"type"`
+	Type string `yaml:"type" validate:"required"`
 	// Address address
-	Address string `yaml:"address"`
+	Address string `yaml:"address" validate:"required"`
 	// AccessKey accesskey
 	AccessKey string `yaml:"accessKey"`
 	// SecretKey secretkey
@@ -169,15 +269,31 @@ type pluginDatabase struct {
 	// Enabled enabled
 	Enabled bool `yaml:"enabled"`
 	// Type database.Driver
-	Type string `yaml:"type"`
+	Type string `yaml:"type" validate:"required"`
 	// Dsn database dsn
-	Dsn string `yaml:"dsn"`
+	Dsn string `yaml:"dsn" validate:"required"`
 	// MaxOpenConns 最大连接数
 	MaxOpenConns int `yaml:"maxOpenConns" default:"0"`
 	// MaxIdleConns 连接池中最大空闲数
 	MaxIdleConns int `yaml:"maxIdleConns" default:"4"`
 }
 
+// pluginOutbox .
+type pluginOutbox struct {
+	// Enabled enabled
+	Enabled bool `yaml:"enabled"`
+	// Table outbox 表名
+	Table string `yaml:"table" default:"outbox_messages"`
+	// Interval 轮询间隔。单位：秒
+	Interval int `yaml:"interval" default:"1"`
+	// BatchSize 每次轮询发布的最大消息数
+	BatchSize int `yaml:"batchSize" default:"100"`
+	// MaxAttempts 最大发布次数
+	MaxAttempts int `yaml:"maxAttempts" default:"10"`
+	// Retention 已发布消息的保留时间。单位：小时
+	Retention int `yaml:"retention" default:"168"`
+}
+
 // engine .
 func (c *configuration) engine() *gin.Engine {
 	gin.SetMode(gin.ReleaseMode)
@@ -262,21 +378,47 @@ func (c *configuration) broker(id string) *lifecycle.Hook {
 	return &lifecycle.Hook{
 		Name: c.Spec.Plugins.Broker.Type,
 		OnStart: func(ctx context.Context) error {
+			if c.Spec.Plugins.Broker.ReconnectWait <= 0 {
+				return errors.Errorf(`load configuration failed: invalid values of 'spec.plugins.broker.reconnectWait: %d'`, c.Spec.Plugins.Broker.ReconnectWait)
+			}
+
+			var client broker.Client
+			var err error
+
 			switch c.Spec.Plugins.Broker.Type {
 			case "nats":
-				return broker.Init(nats.NewClient(id, func(o *broker.Options) {
-					o.Address = c.Spec.Plugins.Broker.Address
-					o.ReconnectWait = time.Duration(c.Spec.Plugins.Broker.ReconnectWait) * time.Second
-				}))
+				client, err = nats.NewClient(id, c.Spec.Plugins.Broker.options)
 			case "kafka":
-				return broker.Init(kafka.NewClient(id, func(o *broker.Options) {
-					o.Version = c.Spec.Plugins.Broker.Version
-					o.Address = c.Spec.Plugins.Broker.Address
+				client, err = kafka.NewClient(id, c.Spec.Plugins.Broker.options, func(o *broker.Options) {
+					// 同一服务的副本共享应答 topic
+					o.ReplyTopic = strings.Join([]string{c.Name, "reply"}, ".")
+				})
+			case "redis":
+				// 使用 spec.plugins.redis 的连接
+				if redis.Client() == nil {
+					return errors.New(`load configuration failed: 'spec.plugins.broker.type: "redis"' requires 'spec.plugins.redis.enabled: true'`)
+				}
+				client, err = redisstream.NewClient(id, redis.Client().Cmdable(), func(o *broker.Options) {
 					o.ReconnectWait = time.Duration(c.Spec.Plugins.Broker.ReconnectWait) * time.Second
-				}))
+				})
+			case "memory":
+				client, err = memory.NewClient(id)
 			default:
 				return errors.Errorf(`load configuration failed: unsupported values of 'spec.plugins.broker.type: "%s"'`, c.Spec.Plugins.Broker.Type)
 			}
+			if err != nil {
+				return err
+			}
+
+			// 延迟发布, 使用 spec.plugins.redis 的连接
+			if c.Spec.Plugins.Broker.Scheduler {
+				if redis.Client() == nil {
+					client.Close()
+					return errors.New(`load configuration failed: 'spec.plugins.broker.scheduler: true' requires 'spec.plugins.redis.enabled: true'`)
+				}
+				return broker.Init(scheduler.NewClient(id, client, redis.Client().Cmdable()))
+			}
+			return broker.Init(client, nil)
 		},
 		OnStop: func(ctx context.Context) error {
 			if broker.C != nil {
@@ -341,6 +483,36 @@ func (c *configuration) database() *lifecycle.Hook {
 	}
 }
 
+// outbox .
+func (c *configuration) outbox(id string) *lifecycle.Hook {
+	if !c.Spec.Plugins.Outbox.Enabled {
+		return nil
+	}
+
+	return &lifecycle.Hook{
+		Name: "outbox",
+		OnStart: func(ctx context.Context) error {
+			if err := outbox.Init(id, orm.DB(), broker.C, func(o *outbox.Options) {
+				o.Table = c.Spec.Plugins.Outbox.Table
+				o.Interval = time.Duration(c.Spec.Plugins.Outbox.Interval) * time.Second
+				o.BatchSize = c.Spec.Plugins.Outbox.BatchSize
+				o.MaxAttempts = c.Spec.Plugins.Outbox.MaxAttempts
+				o.Retention = time.Duration(c.Spec.Plugins.Outbox.Retention) * time.Hour
+			}); err != nil {
+				return errors.Wrap(err, "load configuration failed: 'spec.plugins.outbox' requires 'spec.plugins.database' and 'spec.plugins.broker'")
+			}
+
+			return outbox.Default().Hook().OnStart(ctx)
+		},
+		OnStop: func(ctx context.Context) error {
+			if outbox.Default() == nil {
+				return nil
+			}
+			return outbox.Default().Hook().OnStop(ctx)
+		},
+	}
+}
+
 // websocket .
 func (c *configuration) websocket() *lifecycle.Hook {
 	if !c.Spec.WebSocket.Enabled || !c.Spec.WebSocket.EnSubscription {
@@ -440,6 +612,12 @@ func (c *configuration) server() *Server {
 		srv.lifecycle.Append(hook)
 	}
 
+	// outbox
+	// outbox 需要在 database 和 broker 初始化之后启动
+	if hook := c.outbox(srv.id); hook != nil {
+		srv.lifecycle.Append(hook)
+	}
+
 	// websocket
 	// 若启用 websocket 的 subscribe 功能，websocket.InitStation() 需要在 broker 初始化之后调用
 	if hook := c.websocket(); hook != nil {
@@ -449,10 +627,10 @@ func (c *configuration) server() *Server {
 	return srv
 }
 
-// decode parse conf with Options.ConfPath
+// decode 加载 config.yaml 与 profile 配置文件(APP_PROFILE), 环境变量 APP_* 覆盖对应的配置项, 见 config.Load
 func decode() *configuration {
 	var conf = new(configuration)
-	if err := yaml.NewDecoder().Decode(conf); err != nil {
+	if err := config.Load(conf); err != nil {
 		logger.Fatal(err)
 	}
 	return conf
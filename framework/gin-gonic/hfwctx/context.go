@@ -11,12 +11,15 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 
+	"github.com/charlesbases/library"
+	"github.com/charlesbases/library/codec"
+	"github.com/charlesbases/library/codec/json"
 	"github.com/charlesbases/library/content"
 	"github.com/charlesbases/library/framework/gin-gonic/webserver"
 )
 
 // headerTraceID traceid in context and header
-const headerTraceID = "X-Trace-ID"
+const headerTraceID = library.HeaderTraceID
 
 // ID trace id
 type ID string
@@ -43,9 +46,27 @@ func (c *Context) ID() ID {
 	return c.id
 }
 
-// returnJson .
+// negotiate 按请求头 Accept 选择已注册的 codec.Marshaler, 默认使用 json
+func (c *Context) negotiate() codec.Marshaler {
+	for _, accept := range strings.Split(c.GetHeader("Accept"), ",") {
+		mime, _, _ := strings.Cut(accept, ";")
+		if m, found := codec.Lookup(content.Convert(strings.TrimSpace(mime))); found && codec.Envelope(m) {
+			return m
+		}
+	}
+	return json.Marshaler
+}
+
+// returnJson 响应格式见 negotiate
 func (c *Context) returnJson(v interface{}) {
-	c.JSON(http.StatusOK, v)
+	m := c.negotiate()
+
+	data, err := m.Marshal(v)
+	if err != nil {
+		c.JSON(http.StatusOK, v)
+		return
+	}
+	c.Data(http.StatusOK, m.ContentType().String(), data)
 }
 
 // Successful .
@@ -134,10 +155,12 @@ func ContextHook(ctx context.Context) func(l *logger.Logger) *logger.Logger {
 		if ctx == context.Background() {
 			return l
 		}
-		if val := ctx.Value(headerTraceID); val != nil {
-			if id, ok := val.(ID); ok {
-				return l.Named(id.String())
-			}
+		switch id := ctx.Value(headerTraceID).(type) {
+		case ID:
+			return l.Named(id.String())
+		case string:
+			// trace id from broker.Event.Context()
+			return l.Named(id)
 		}
 		return l
 	}
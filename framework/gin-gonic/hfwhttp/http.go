@@ -14,10 +14,10 @@ import (
 	"time"
 
 	"github.com/charlesbases/logger"
-	"github.com/golang/protobuf/proto"
 	"github.com/pkg/errors"
 
 	"github.com/charlesbases/library"
+	"github.com/charlesbases/library/codec/proto"
 )
 
 const _defaultConnectTimeout = 3 * time.Second
@@ -44,8 +44,8 @@ type Data []byte
 
 // Unmarshal .
 func (data Data) Unmarshal(pointer interface{}) error {
-	if v, ok := pointer.(proto.Message); ok {
-		return proto.Unmarshal(data, v)
+	if err := proto.Marshaler.Unmarshal(data, pointer); !errors.Is(err, proto.ErrInvalidType) {
+		return err
 	}
 	return json.Unmarshal(data, pointer)
 }
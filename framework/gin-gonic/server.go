@@ -2,6 +2,7 @@ package gin_gonic
 
 import (
 	"os"
+	"time"
 
 	"github.com/charlesbases/logger"
 	"github.com/gin-gonic/gin"
@@ -65,11 +66,26 @@ func (srv *Server) Publish(topic string, v interface{}, opts ...func(o *broker.P
 	return broker.C.Publish(topic, v, opts...)
 }
 
+// PublishSync 消息同步发布, 等待 broker 确认
+func (srv *Server) PublishSync(topic string, v interface{}, opts ...func(o *broker.PublishOptions)) (*broker.Receipt, error) {
+	return broker.C.PublishSync(topic, v, opts...)
+}
+
+// PublishBatch 批量发布消息, 等待全部消息确认
+func (srv *Server) PublishBatch(topic string, vs []interface{}, opts ...func(o *broker.PublishOptions)) ([]broker.Result, error) {
+	return broker.C.PublishBatch(topic, vs, opts...)
+}
+
 // Subscribe 消息异步订阅
-func (srv *Server) Subscribe(topic string, handler broker.Handler, opts ...func(o *broker.SubscribeOptions)) error {
+func (srv *Server) Subscribe(topic string, handler broker.Handler, opts ...func(o *broker.SubscribeOptions)) (broker.Subscription, error) {
 	return broker.C.Subscribe(topic, handler, opts...)
 }
 
+// Request 发送请求并等待应答
+func (srv *Server) Request(topic string, v interface{}, timeout time.Duration, opts ...func(o *broker.PublishOptions)) (broker.Event, error) {
+	return broker.C.Request(topic, v, timeout, opts...)
+}
+
 // Unmarshal 序列化 configuration 中的自定义配置项
 func (srv *Server) Unmarshal(v interface{}) error {
 	data, err := json.Marshaler.Marshal(&srv.data)
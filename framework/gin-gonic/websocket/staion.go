@@ -1,8 +1,10 @@
 package websocket
 
 import (
+	"context"
 	"sync"
 
+	"github.com/charlesbases/logger"
 	"github.com/pkg/errors"
 
 	"github.com/charlesbases/library"
@@ -10,13 +12,15 @@ import (
 	"github.com/charlesbases/library/framework/gin-gonic/hfwctx"
 )
 
-var es = &eventStaion{subjects: make(map[subject]subscriberGroup, 0)}
+var es = &eventStaion{subjects: make(map[subject]subscriberGroup, 0), subscriptions: make(map[subject]broker.Subscription, 0)}
 
 // eventStaion .
 type eventStaion struct {
 	client broker.Client
 
 	subjects map[subject]subscriberGroup
+	// subscriptions broker 订阅。subject 下所有 session 取消订阅后, 取消 broker 订阅
+	subscriptions map[subject]broker.Subscription
 
 	lock sync.RWMutex
 }
@@ -58,13 +62,31 @@ func (es *eventStaion) subscribe(subs ...*subscriber) {
 
 // unsubscribe .
 func (es *eventStaion) unsubscribe(subs ...*subscriber) {
+	var idle = make([]broker.Subscription, 0)
+
 	es.lock.Lock()
 	for _, sub := range subs {
 		if group, found := es.subjects[sub.subject]; found {
 			delete(group, sub.sessionID)
+
+			if len(group) == 0 {
+				delete(es.subjects, sub.subject)
+
+				if subscription, found := es.subscriptions[sub.subject]; found {
+					delete(es.subscriptions, sub.subject)
+					idle = append(idle, subscription)
+				}
+			}
 		}
 	}
 	es.lock.Unlock()
+
+	// 所有 session 均已取消订阅的 subject, 取消 broker 订阅
+	for _, subscription := range idle {
+		if err := subscription.Unsubscribe(); err != nil {
+			logger.Errorf("[websocket]: unsubscribe[%s]: %v", subscription.Topic(), err)
+		}
+	}
 }
 
 // newSubscriberGroup .
@@ -73,13 +95,17 @@ func (es *eventStaion) newSubscriberGroup(subject subject) subscriberGroup {
 	es.subjects[subject] = subscriberGroup
 
 	// broker.Subscribe
-	es.client.Subscribe(string(subject), es.console)
+	if subscription, err := es.client.Subscribe(string(subject), es.console); err != nil {
+		logger.Errorf("[websocket]: subscribe[%s]: %v", subject, err)
+	} else {
+		es.subscriptions[subject] = subscription
+	}
 
 	return subscriberGroup
 }
 
 // console .
-func (es *eventStaion) console(event broker.Event) error {
+func (es *eventStaion) console(ctx context.Context, event broker.Event) error {
 	var subject = subject(event.Topic())
 
 	es.lock.RLock()
@@ -0,0 +1,4 @@
+package library
+
+// HeaderTraceID trace id in context and header
+const HeaderTraceID = "X-Trace-ID"
@@ -159,6 +159,36 @@ func (r *rkv) Set(key keyword, val interface{}, opts ...func(o *SetOptions)) *St
 	return output
 }
 
+// SetNX key 不存在时设置。key 已存在时 BoolOutput.Val() 为 false
+func (r *rkv) SetNX(key keyword, val interface{}, opts ...func(o *SetOptions)) *BoolOutput {
+	var sopts = setoptions(opts...)
+
+	output := &BoolOutput{baseOutput: baseOutput{ctx: sopts.Context, key: string(key)}}
+	if !r.isReady() {
+		output.err = errors.Errorf("[redis](%s): setnx: %v", key, ErrRedisNotReady)
+		return output
+	}
+
+	if !sopts.Expiry.IsZero() {
+		sopts.TTL = time.Until(sopts.Expiry)
+	}
+
+	data, err := sopts.Marshaler.Marshal(val)
+	if err != nil {
+		output.err = errors.Errorf("[redis](%s): setnx: %v", key, err)
+		return output
+	}
+
+	ok, err := r.client.SetNX(sopts.Context, string(key), data, sopts.TTL).Result()
+	if err != nil {
+		output.err = errors.Errorf("[redis](%s): setnx: %v", key, err)
+		return output
+	}
+
+	output.val = ok
+	return output
+}
+
 // Get .
 func (r *rkv) Get(key keyword, opts ...func(o *GetOptions)) *BytesOutput {
 	var gopts = getoptions(opts...)
@@ -269,6 +299,14 @@ func (r *rkv) IsExists(key string, opts ...func(o *GetOptions)) *BoolOutput {
 	return output
 }
 
+// Cmdable 底层 redis 连接, 用于执行未封装的命令
+func (r *rkv) Cmdable() redis.Cmdable {
+	if r == nil {
+		return nil
+	}
+	return r.client
+}
+
 // Close .
 func (r *rkv) Close() error {
 	if r.closing != nil {
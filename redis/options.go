@@ -9,6 +9,12 @@ import (
 
 	"github.com/charlesbases/library/codec"
 	"github.com/charlesbases/library/codec/json"
+	"github.com/charlesbases/library/content"
+
+	// 注册内置的 codec.Marshaler, 见 SetOptions.ContentType
+	_ "github.com/charlesbases/library/codec/cbor"
+	_ "github.com/charlesbases/library/codec/msgpack"
+	_ "github.com/charlesbases/library/codec/proto"
 )
 
 var (
@@ -93,6 +99,8 @@ type SetOptions struct {
 	Expiry time.Time
 	// Marshaler value 编码方式
 	Marshaler codec.Marshaler
+	// ContentType value 编码格式。设置且已注册时使用对应的 codec.Marshaler, 覆盖 Marshaler
+	ContentType *content.Type
 }
 
 // setoptions .
@@ -104,6 +112,12 @@ func setoptions(opts ...func(o *SetOptions)) *SetOptions {
 	for _, opt := range opts {
 		opt(o)
 	}
+
+	if o.ContentType != nil {
+		if m, found := codec.Lookup(*o.ContentType); found {
+			o.Marshaler = m
+		}
+	}
 	return o
 }
 
@@ -112,6 +126,8 @@ type GetOptions struct {
 	Context context.Context
 	// Marshaler value 编码方式
 	Marshaler codec.Marshaler
+	// ContentType value 编码格式。设置且已注册时使用对应的 codec.Marshaler, 覆盖 Marshaler
+	ContentType *content.Type
 }
 
 // getoptions .
@@ -123,6 +139,12 @@ func getoptions(opts ...func(o *GetOptions)) *GetOptions {
 	for _, opt := range opts {
 		opt(o)
 	}
+
+	if o.ContentType != nil {
+		if m, found := codec.Lookup(*o.ContentType); found {
+			o.Marshaler = m
+		}
+	}
 	return o
 }
 
@@ -13,7 +13,14 @@ import (
 
 	"google.golang.org/protobuf/proto"
 
+	"github.com/charlesbases/library/codec"
 	"github.com/charlesbases/library/content"
+
+	// 注册 Decode 使用的 codec.Marshaler
+	_ "github.com/charlesbases/library/codec/cbor"
+	_ "github.com/charlesbases/library/codec/json"
+	_ "github.com/charlesbases/library/codec/msgpack"
+	_ "github.com/charlesbases/library/codec/proto"
 )
 
 // ErrNoSuchKey .
@@ -187,6 +194,20 @@ func InputMarshalProto(bucket string, key string, v proto.Message) ObjectInput {
 	}
 }
 
+// InputMarshal 使用 'm' 编码, 如 compress、encrypt 包装后的 codec.Marshaler
+func InputMarshal(bucket string, key string, v interface{}, m codec.Marshaler) ObjectInput {
+	data, err := m.Marshal(v)
+	if err != nil {
+		return &input{bucket: bucket, key: key, err: err}
+	}
+	return &input{
+		bucket: bucket,
+		key:    key,
+		ct:     m.ContentType(),
+		body:   bytes.NewReader(data),
+	}
+}
+
 // InputReadSeeker .
 func InputReadSeeker(bucket string, key string, body io.ReadSeeker) ObjectInput {
 	return &input{
@@ -211,6 +232,8 @@ type ObjectOutput interface {
 	Key() string
 	ContentType() content.Type
 	Decode(vPointer interface{}) error
+	// DecodeWith 使用 'm' 解码, 见 InputMarshal
+	DecodeWith(vPointer interface{}, m codec.Marshaler) error
 	Body() io.ReadCloser
 	Close() error
 }
@@ -251,16 +274,27 @@ func (o *output) Decode(vPointer interface{}) error {
 	case *string:
 		*(vPointer.(*string)) = string(buff.Bytes())
 	default:
-		if pm, ok := vPointer.(proto.Message); ok && o.ct == content.Proto.String() {
-			return proto.Unmarshal(buff.Bytes(), pm)
-		} else {
-			return json.Unmarshal(buff.Bytes(), vPointer)
+		// 按对象的 content-type 选择已注册的 codec.Marshaler, 未注册时使用 json
+		if m, found := codec.Lookup(o.ContentType()); found {
+			return m.Unmarshal(buff.Bytes(), vPointer)
 		}
+		return json.Unmarshal(buff.Bytes(), vPointer)
 	}
 
 	return nil
 }
 
+// DecodeWith .
+func (o *output) DecodeWith(vPointer interface{}, m codec.Marshaler) error {
+	defer o.Close()
+
+	data, err := io.ReadAll(o.body)
+	if err != nil {
+		return err
+	}
+	return m.Unmarshal(data, vPointer)
+}
+
 // Bucket .
 func (o *output) Bucket() string {
 	return o.bucket